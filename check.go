@@ -0,0 +1,40 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"os"
+)
+
+// runCheck validates the configuration file, failing also on unknown fields,
+// shadowed and duplicate patterns.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	source := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	problems, err := proxy.CheckConfig(*source, mkLogger("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", source.Path, err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", source.Path, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"os"
+)
+
+// runConfig runs the config subcommands.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "convert" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config convert [options]\n", os.Args[0])
+		return 2
+	}
+	return runConfigConvert(args[1:])
+}
+
+// runConfigConvert prints the effective configuration, with defaults,
+// included files and overrides merged, in the requested format. The rules
+// from the system proxy variables are left to SystemProxyRules.
+func runConfigConvert(args []string) int {
+	flags := flag.NewFlagSet("config convert", flag.ExitOnError)
+	outputFormat := flags.String("to", proxy.FormatToml, "output format: toml, json or yaml")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s config convert [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	source := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	cfg, err := proxy.LoadMergedConfig(*source, mkLogger("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load config file: %v\n", err)
+		return 1
+	}
+	if err := proxy.EncodeConfig(os.Stdout, cfg, *outputFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot convert config: %v\n", err)
+		return 1
+	}
+	return 0
+}
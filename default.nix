@@ -15,5 +15,5 @@ pkgs.buildGoModule {
   pname = "flexi-proxy";
   version = "0.1";
   src = ./.;
-  vendorHash = "sha256-KI/+s3qVMtqfpb2MpQQsqkng6nNyeXH+H9Km6C9SIbU=";
+  vendorHash = "sha256-18pC7bJToG3kN29N6s0rERwMRVO3bjMO58UMk9B/VeA=";
 }
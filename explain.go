@@ -0,0 +1,73 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"os"
+)
+
+// runExplain prints how the rules resolve the dialer for a target.
+func runExplain(args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	client := flags.String("client", "", "client address, for rules with Sources")
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s explain [options] host[:port]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	source := addConfigFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	target, err := proxy.ParseTarget(flags.Arg(0), "https")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid target: %v\n", err)
+		return 2
+	}
+	env, err := proxy.LoadEnvironment(*source, mkLogger("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load config file: %v\n", err)
+		return 1
+	}
+	explanation := proxy.Explain(env, target, *client)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(explanation); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write result: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Printf("target: %s\n", explanation.Target)
+	fmt.Printf("ip: %s\n", explanation.IP)
+	for _, r := range explanation.Rules {
+		proxyUrl := r.Proxy
+		if proxyUrl == "" {
+			proxyUrl = "DIRECT"
+		}
+		result := "matches"
+		if !r.Matched {
+			result = r.Reason
+		}
+		if r.Pattern == "" {
+			fmt.Printf("rule[%d] (%s): %s\n", r.Rule, proxyUrl, result)
+		} else {
+			fmt.Printf("rule[%d] (%s) pattern `%s`: %s\n", r.Rule, proxyUrl, r.Pattern, result)
+		}
+	}
+	if explanation.Rule < 0 {
+		fmt.Printf("no rule matches\n")
+	}
+	fmt.Printf("dialer: %s\n", explanation.Dialer)
+	return 0
+}
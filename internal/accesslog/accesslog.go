@@ -0,0 +1,226 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats, common is the default.
+const (
+	// FormatCommon is the Common Log Format followed by the bytes sent
+	// upstream, the duration in milliseconds, the rule and the dialer
+	FormatCommon = "common"
+	// FormatCombined is like FormatCommon with the referer and the user agent
+	// after the standard fields, like the Combined Log Format
+	FormatCombined = "combined"
+	FormatJson     = "json"
+)
+
+// Entry summarizes an HTTP request, a CONNECT tunnel or a SOCKS session
+// when it ends.
+type Entry struct {
+	Start time.Time `json:"start"`
+	// Duration is encoded as durationMs, in milliseconds like in the text
+	// formats
+	Duration time.Duration `json:"-"`
+	// Listener is `http` or `socks`
+	Listener string `json:"listener"`
+	Client   string `json:"client"`
+	Method   string `json:"method"`
+	Target   string `json:"target"`
+	Protocol string `json:"protocol,omitempty"`
+	// Rule is the index of the matching rule, -1 when no rule matches
+	Rule   int    `json:"rule"`
+	Dialer string `json:"dialer,omitempty"`
+	// Status is the final HTTP status, SOCKS sessions use the HTTP status
+	// equivalent to their reply
+	Status int `json:"status"`
+	// Upstream and Downstream are the bytes sent to and received from
+	// the target. Plain HTTP requests share upstream connections, so only
+	// their bodies are counted, like the bytes of the Common Log Format.
+	Upstream   int64  `json:"bytesUp"`
+	Downstream int64  `json:"bytesDown"`
+	Referer    string `json:"referer,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Finish records the end of the request with its final status and
+// the failure, if any.
+func (e *Entry) Finish(status int, err error) {
+	e.Duration = time.Since(e.Start)
+	e.Status = status
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// Record finishes the entry and writes it to the recorder.
+func (e *Entry) Record(r Recorder, status int, err error) {
+	e.Finish(status, err)
+	r.AccessLog(e)
+}
+
+// MarshalJSON encodes the entry with the duration in milliseconds.
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	type fields Entry
+	return json.Marshal(struct {
+		*fields
+		DurationMillis int64 `json:"durationMs"`
+	}{(*fields)(e), e.Duration.Milliseconds()})
+}
+
+// Recorder writes the finished entries to the access log.
+type Recorder interface {
+	AccessLog(entry *Entry)
+}
+
+// Config selects the access log file, its format and rotation.
+type Config struct {
+	// Path of the file, `-` for stdout, empty to disable the log
+	Path   string
+	Format string
+	// MaxSizeMB is the size at which the file is rotated, 100 when zero
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files to keep, all when zero
+	MaxBackups int
+}
+
+func (c Config) Validate() error {
+	switch c.Format {
+	case "", FormatCommon, FormatCombined, FormatJson:
+	default:
+		return fmt.Errorf("unknown access log format `%s`", c.Format)
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("access log rotation limits cannot be negative")
+	}
+	return nil
+}
+
+// Log writes the entries to the configured file. The file is opened by
+// the first entry, so a log which is never written is not created.
+type Log struct {
+	mu     sync.Mutex
+	config Config
+	output io.WriteCloser
+}
+
+func New() *Log {
+	return &Log{}
+}
+
+// Configure applies the config, a different file is used by the next entry.
+func (l *Log) Configure(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg == l.config {
+		return
+	}
+	l.close()
+	l.config = cfg
+}
+
+// Write writes the entry in the configured format.
+func (l *Log) Write(e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.Path == "" {
+		return nil
+	}
+	if l.output == nil {
+		l.output = l.open()
+	}
+	var line []byte
+	if l.config.Format == FormatJson {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	} else {
+		line = []byte(formatText(e, l.config.Format == FormatCombined))
+	}
+	_, err := l.output.Write(line)
+	return err
+}
+
+// Close closes the file, the next entry opens it again.
+func (l *Log) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.close()
+}
+
+func (l *Log) open() io.WriteCloser {
+	if l.config.Path == "-" {
+		return nopCloser{os.Stdout}
+	}
+	return &lumberjack.Logger{
+		Filename:   l.config.Path,
+		MaxSize:    l.config.MaxSizeMB,
+		MaxBackups: l.config.MaxBackups,
+		LocalTime:  true,
+	}
+}
+
+func (l *Log) close() {
+	if l.output != nil {
+		_ = l.output.Close()
+		l.output = nil
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// formatText formats the entry like a Common or Combined Log Format line,
+// with the extra fields appended.
+func formatText(e *Entry, combined bool) string {
+	var b strings.Builder
+	host, _, err := net.SplitHostPort(e.Client)
+	if err != nil {
+		host = e.Client
+	}
+	protocol := e.Protocol
+	if protocol == "" {
+		protocol = "-"
+	}
+	fmt.Fprintf(&b, "%s - - [%s] %s %d %d",
+		dash(host), e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Target+" "+protocol), e.Status, e.Downstream,
+	)
+	if combined {
+		fmt.Fprintf(&b, " %s %s", strconv.Quote(dash(e.Referer)), strconv.Quote(dash(e.UserAgent)))
+	}
+	fmt.Fprintf(&b, " %d %d %d %s", e.Upstream, e.Duration.Milliseconds(), e.Rule, strconv.Quote(dash(e.Dialer)))
+	if e.Error != "" {
+		fmt.Fprintf(&b, " %s", strconv.Quote(e.Error))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry() *Entry {
+	e := &Entry{
+		Start:      time.Date(2023, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Listener:   "http",
+		Client:     "[::1]:50000",
+		Method:     "GET",
+		Target:     "http://example.com/",
+		Protocol:   "HTTP/1.1",
+		Rule:       2,
+		Dialer:     "PROXY http://proxy.test:3128",
+		Upstream:   120,
+		Downstream: 2326,
+		UserAgent:  "curl/8.0",
+	}
+	e.Finish(200, nil)
+	e.Duration = 1500 * time.Millisecond
+	return e
+}
+
+func TestFormatText(t *testing.T) {
+	e := testEntry()
+	common := `::1 - - [10/Oct/2023:13:55:36 -0700] "GET http://example.com/ HTTP/1.1" 200 2326 120 1500 2 "PROXY http://proxy.test:3128"` + "\n"
+	if line := formatText(e, false); line != common {
+		t.Fatalf("Common line should be `%s`, got `%s`", common, line)
+	}
+	combined := `::1 - - [10/Oct/2023:13:55:36 -0700] "GET http://example.com/ HTTP/1.1" 200 2326 "-" "curl/8.0" 120 1500 2 "PROXY http://proxy.test:3128"` + "\n"
+	if line := formatText(e, true); line != combined {
+		t.Fatalf("Combined line should be `%s`, got `%s`", combined, line)
+	}
+	e = &Entry{Start: e.Start, Client: "10.0.0.1:1080", Method: "CONNECT", Target: "a.test:443", Rule: -1}
+	e.Finish(502, errors.New("refused"))
+	e.Duration = 0
+	failed := `" 502 0 0 0 -1 "-" "refused"` + "\n"
+	if line := formatText(e, false); !strings.HasPrefix(line, `10.0.0.1 - - [`) || !strings.HasSuffix(line, failed) {
+		t.Fatalf("Failed line should end with `%s`, got `%s`", failed, line)
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	l := New()
+	defer l.Close()
+	if err := l.Write(testEntry()); err != nil {
+		t.Fatalf("Disabled log should ignore entries, got %v", err)
+	}
+	if (Config{Format: "xml"}).Validate() == nil {
+		t.Fatalf("Format `xml` should be rejected")
+	}
+	first := filepath.Join(dir, "access.log")
+	l.Configure(Config{Path: first})
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatalf("Log should be created by the first entry, got %v", err)
+	}
+	if err := l.Write(testEntry()); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	second := filepath.Join(dir, "access.json")
+	l.Configure(Config{Path: second, Format: FormatJson})
+	if err := l.Write(testEntry()); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	data, err := os.ReadFile(first)
+	if err != nil || !strings.HasPrefix(string(data), "::1 - - [") || strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("First log should have a text entry, got `%s` %v", data, err)
+	}
+	data, err = os.ReadFile(second)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Target != "http://example.com/" || entry.Downstream != 2326 || entry.Rule != 2 {
+		t.Fatalf("Second log should have a JSON entry, got `%s` %v", data, err)
+	}
+	if !strings.Contains(string(data), `"durationMs":1500`) {
+		t.Fatalf("JSON entry should have the duration in milliseconds, got `%s`", data)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/conntrack"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handler serves the admin API, all requests need the admin token given
+// as a bearer token:
+//   - GET /config: the effective configuration, without secrets
+//   - GET /connections: the active connections
+//   - DELETE /connections/{id}: kills the connection
+//   - GET, PUT /verbosity: the log verbosity, a change lasts until the next
+//     reload, e.g. PUT {"verbosity": "debug"}
+//   - GET /reload: the reload status and the applied configurations
+//   - POST /reload: reloads the configuration
+//   - POST /rollback: rolls back to the previous configuration
+//   - GET /resolve?target=host[:port]&client=addr: explains which dialer
+//     is used for the target
+type handler struct {
+	env    *environment.Environment
+	loader *proxy.EnvLoader
+	conns  *conntrack.Registry
+	mux    *http.ServeMux
+}
+
+func NewHandler(env *environment.Environment, loader *proxy.EnvLoader, conns *conntrack.Registry) http.Handler {
+	h := &handler{
+		env:    env,
+		loader: loader,
+		conns:  conns,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/config", h.handleConfig)
+	h.mux.HandleFunc("/connections", h.handleConnections)
+	h.mux.HandleFunc("/connections/", h.handleConnection)
+	h.mux.HandleFunc("/verbosity", h.handleVerbosity)
+	h.mux.HandleFunc("/reload", h.handleReload)
+	h.mux.HandleFunc("/rollback", h.handleRollback)
+	h.mux.HandleFunc("/resolve", h.handleResolve)
+	return h
+}
+
+func (h *handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	// the token of the current config, so a reload can change it
+	token := h.env.Config().AdminToken
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		h.env.Warn("Unauthorized admin request", "client", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+		res.Header().Set("WWW-Authenticate", `Bearer realm="flexi-proxy"`)
+		writeError(res, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+		return
+	}
+	h.env.Debug("Admin request", "client", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+	h.mux.ServeHTTP(res, req)
+}
+
+func (h *handler) handleConfig(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	var encoded bytes.Buffer
+	if err := proxy.EncodeConfig(&encoded, h.env.Config().Redacted(), proxy.FormatJson); err != nil {
+		writeError(res, http.StatusInternalServerError, err)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(encoded.Bytes())
+}
+
+func (h *handler) handleConnections(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	writeJson(res, http.StatusOK, h.conns.List())
+}
+
+func (h *handler) handleConnection(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodDelete) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		writeError(res, http.StatusNotFound, fmt.Errorf("invalid connection id"))
+		return
+	}
+	if !h.conns.Kill(id) {
+		writeError(res, http.StatusNotFound, fmt.Errorf("connection %d does not exist", id))
+		return
+	}
+	h.env.Warn("Killed connection", "conn", id, "client", req.RemoteAddr)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+type verbosityBody struct {
+	// Verbosity is a name, like `debug`, or a number
+	Verbosity interface{} `json:"verbosity"`
+}
+
+func (h *handler) handleVerbosity(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		var body verbosityBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Verbosity == nil {
+			writeError(res, http.StatusBadRequest, fmt.Errorf("expected {\"verbosity\": name or number}"))
+			return
+		}
+		v, err := proxy.ParseVerbosity(fmt.Sprint(body.Verbosity))
+		if err != nil {
+			writeError(res, http.StatusBadRequest, err)
+			return
+		}
+		h.env.SetVerbosity(v)
+		h.env.Info("Changed verbosity", "verbosity", v, "client", req.RemoteAddr)
+	}
+	writeJson(res, http.StatusOK, verbosityBody{Verbosity: int(h.env.Config().Verbosity)})
+}
+
+func (h *handler) handleReload(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if req.Method == http.MethodPost {
+		h.env.Info("Reloading configuration", "client", req.RemoteAddr)
+		if err := h.loader.Reload(); err != nil {
+			writeError(res, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJson(res, http.StatusOK, h.loader.Status())
+}
+
+func (h *handler) handleRollback(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodPost) {
+		return
+	}
+	h.env.Info("Rolling back configuration", "client", req.RemoteAddr)
+	revision, err := h.loader.Rollback()
+	if err != nil {
+		writeError(res, http.StatusConflict, err)
+		return
+	}
+	writeJson(res, http.StatusOK, revision)
+}
+
+func (h *handler) handleResolve(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	query := req.URL.Query()
+	target, err := proxy.ParseTarget(query.Get("target"), "https")
+	if err != nil {
+		writeError(res, http.StatusBadRequest, fmt.Errorf("invalid target: %w", err))
+		return
+	}
+	writeJson(res, http.StatusOK, proxy.Explain(h.env, target, query.Get("client")))
+}
+
+// allowMethods responds with 405 when the request method is not allowed.
+func allowMethods(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	res.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+	return false
+}
+
+func writeJson(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(v)
+}
+
+func writeError(res http.ResponseWriter, status int, err error) {
+	writeJson(res, status, map[string]string{"error": err.Error()})
+}
+
+// ListenAndServe serves the admin API on the configured address until
+// the context is done.
+func ListenAndServe(ctx context.Context, env *environment.Environment, loader *proxy.EnvLoader, conns *conntrack.Registry) error {
+	addr := env.Config().AdminListenAddr
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           NewHandler(env, loader, conns),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          env.Logger(),
+	}
+	env.Info("Serving admin API", "url", "http://"+addr)
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
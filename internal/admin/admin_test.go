@@ -0,0 +1,117 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"github.com/psvo/flexi-proxy/internal/conntrack"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T) (http.Handler, *proxy.EnvLoader, *conntrack.Registry) {
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	config := `
+AdminToken = "secret"
+[[Rules]]
+Proxy = "http://proxy.test:3128"
+Patterns = [".corp"]
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	loader, err := proxy.NewEnvironmentLoader(proxy.ConfigSource{Path: path}, time.Hour, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	t.Cleanup(loader.Stop)
+	conns := conntrack.NewRegistry()
+	return NewHandler(loader.Env(), loader, conns), loader, conns
+}
+
+func serve(h http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestHandler_Token(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/connections", nil)
+		req.Header.Set("Authorization", auth)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization `%s` should be rejected, got %d", auth, res.Code)
+		}
+	}
+	if res := serve(h, http.MethodGet, "/config", ""); res.Code != http.StatusOK || strings.Contains(res.Body.String(), "secret") {
+		t.Fatalf("Config should be dumped without the token, got %d %s", res.Code, res.Body)
+	}
+}
+
+func TestHandler_Connections(t *testing.T) {
+	h, _, conns := newTestHandler(t)
+	tracked := conns.Add("http", "127.0.0.1:5000", "a.corp:443")
+	killed := false
+	tracked.OnKill(func() { killed = true })
+	res := serve(h, http.MethodGet, "/connections", "")
+	var infos []conntrack.Info
+	if err := json.Unmarshal(res.Body.Bytes(), &infos); err != nil || len(infos) != 1 || infos[0].Target != "a.corp:443" {
+		t.Fatalf("Connection should be listed, got %s %v", res.Body, err)
+	}
+	if res := serve(h, http.MethodDelete, "/connections/42", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("Unknown connection should not be found, got %d", res.Code)
+	}
+	if res := serve(h, http.MethodDelete, "/connections/1", ""); res.Code != http.StatusNoContent || !killed {
+		t.Fatalf("Connection should be killed, got %d", res.Code)
+	}
+	if res := serve(h, http.MethodPost, "/connections", ""); res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST should not be allowed, got %d", res.Code)
+	}
+}
+
+func TestHandler_Verbosity(t *testing.T) {
+	h, loader, _ := newTestHandler(t)
+	if res := serve(h, http.MethodPut, "/verbosity", `{"verbosity": "loud"}`); res.Code != http.StatusBadRequest {
+		t.Fatalf("Unknown verbosity should be rejected, got %d", res.Code)
+	}
+	res := serve(h, http.MethodPut, "/verbosity", `{"verbosity": "debug"}`)
+	if res.Code != http.StatusOK || loader.Env().Config().Verbosity != environment.Debug {
+		t.Fatalf("Verbosity should be changed, got %d %s", res.Code, res.Body)
+	}
+	if res := serve(h, http.MethodPost, "/reload", ""); res.Code != http.StatusOK {
+		t.Fatalf("Config should be reloaded, got %d %s", res.Code, res.Body)
+	}
+	if v := loader.Env().Config().Verbosity; v != environment.Error {
+		t.Fatalf("Reload should restore the configured verbosity, got %d", v)
+	}
+	if res := serve(h, http.MethodPost, "/rollback", ""); res.Code != http.StatusOK {
+		t.Fatalf("Config should be rolled back, got %d %s", res.Code, res.Body)
+	}
+}
+
+func TestHandler_Resolve(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+	res := serve(h, http.MethodGet, "/resolve?target=a.corp", "")
+	var explanation proxy.Explanation
+	if err := json.Unmarshal(res.Body.Bytes(), &explanation); err != nil || explanation.Rule != 0 || explanation.Dialer != "PROXY http://proxy.test:3128" {
+		t.Fatalf("Target should be resolved by the rule, got %s %v", res.Body, err)
+	}
+	if res := serve(h, http.MethodGet, "/resolve", ""); res.Code != http.StatusBadRequest {
+		t.Fatalf("Missing target should be rejected, got %d", res.Code)
+	}
+}
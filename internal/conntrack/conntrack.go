@@ -0,0 +1,391 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons of closing a connection by the registry.
+var (
+	ErrKilled      = errors.New("connection killed")
+	ErrIdleTimeout = errors.New("idle timeout")
+	ErrMaxLifetime = errors.New("maximum lifetime reached")
+)
+
+// Registry tracks the active connections of the proxies, so they can be
+// listed and killed.
+type Registry struct {
+	mu     sync.Mutex
+	lastID uint64
+	conns  map[uint64]*Conn
+	// empty is closed when the last connection is done, it is created
+	// by Wait
+	empty chan struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		conns: map[uint64]*Conn{},
+	}
+}
+
+// Conn is a tracked HTTP request, CONNECT tunnel or SOCKS session.
+type Conn struct {
+	registry *Registry
+	id       uint64
+	start    time.Time
+	listener string
+	client   string
+	target   string
+	// mu guards the route and closing
+	mu      sync.Mutex
+	rule    int
+	dialer  string
+	closers []func()
+	// err is the reason of closing the connection by the registry
+	err        error
+	upstream   atomic.Int64
+	downstream atomic.Int64
+	// lastActive is the time of the last transfer, in Unix nanoseconds
+	lastActive atomic.Int64
+}
+
+// Info describes a tracked connection.
+type Info struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	// Age is the time since the start, in nanoseconds
+	Age time.Duration `json:"age"`
+	// Rule is the index of the matching rule, -1 when no rule matches
+	Rule       int    `json:"rule"`
+	Dialer     string `json:"dialer,omitempty"`
+	Upstream   int64  `json:"bytesUp"`
+	Downstream int64  `json:"bytesDown"`
+}
+
+// Add starts tracking a connection of the client to the target, until
+// Conn.Done is called.
+func (r *Registry) Add(listener, client, target string) *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	c := &Conn{
+		registry: r,
+		id:       r.lastID,
+		start:    time.Now(),
+		listener: listener,
+		client:   client,
+		target:   target,
+		rule:     -1,
+	}
+	c.lastActive.Store(c.start.UnixNano())
+	r.conns[c.id] = c
+	return c
+}
+
+// List returns the tracked connections, ordered by their start.
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	infos := make([]Info, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.Info())
+	}
+	return infos
+}
+
+// Kill closes the connection with the id. It returns false when there is
+// no such connection.
+func (r *Registry) Kill(id uint64) bool {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+	if ok {
+		c.Kill()
+	}
+	return ok
+}
+
+// Count returns the number of tracked connections.
+func (r *Registry) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// KillAll kills all tracked connections and returns their number.
+func (r *Registry) KillAll() int {
+	r.mu.Lock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	for _, c := range conns {
+		c.Kill()
+	}
+	return len(conns)
+}
+
+// Wait waits until no connection is tracked. It returns false when
+// the context is done first.
+func (r *Registry) Wait(ctx context.Context) bool {
+	r.mu.Lock()
+	if len(r.conns) == 0 {
+		r.mu.Unlock()
+		return true
+	}
+	if r.empty == nil {
+		r.empty = make(chan struct{})
+	}
+	empty := r.empty
+	r.mu.Unlock()
+	select {
+	case <-empty:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// SetTarget records the target, once it is known.
+func (c *Conn) SetTarget(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = target
+}
+
+// SetRoute records the index of the rule and the dialer used for the target.
+func (c *Conn) SetRoute(rule int, dialer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rule, c.dialer = rule, dialer
+}
+
+// OnKill registers a function closing the connection when it is killed or
+// limited. The function is called right away when the connection was
+// closed already.
+func (c *Conn) OnKill(fn func()) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.closers = append(c.closers, fn)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	fn()
+}
+
+// Kill closes the connection by the registered functions.
+func (c *Conn) Kill() {
+	c.close(ErrKilled)
+}
+
+func (c *Conn) close(reason error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	closers := c.closers
+	c.closers, c.err = nil, reason
+	c.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+// Err returns the reason of closing the connection by Kill or by its limits,
+// nil when it was not closed this way.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Limit closes the connection when nothing is transferred for the idle
+// timeout, or when it is open for the lifetime. Zero disables either limit.
+// The returned function stops the limits.
+func (c *Conn) Limit(idle, lifetime time.Duration) (stop func()) {
+	if idle <= 0 && lifetime <= 0 {
+		return func() {}
+	}
+	var mu sync.Mutex
+	var timer *time.Timer
+	stopped := false
+	var check func()
+	check = func() {
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			return
+		}
+		next, reason := c.limitReached(idle, lifetime)
+		if reason == nil {
+			timer = time.AfterFunc(time.Until(next), check)
+		}
+		mu.Unlock()
+		if reason != nil {
+			c.close(reason)
+		}
+	}
+	check()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Done stops tracking the connection.
+func (c *Conn) Done() {
+	r := c.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+	if len(r.conns) == 0 && r.empty != nil {
+		close(r.empty)
+		r.empty = nil
+	}
+}
+
+func (c *Conn) Upstream() int64 {
+	return c.upstream.Load()
+}
+
+func (c *Conn) Downstream() int64 {
+	return c.downstream.Load()
+}
+
+func (c *Conn) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Info{
+		ID:         c.id,
+		Listener:   c.listener,
+		Client:     c.client,
+		Target:     c.target,
+		Start:      c.start,
+		Age:        time.Since(c.start),
+		Rule:       c.rule,
+		Dialer:     c.dialer,
+		Upstream:   c.upstream.Load(),
+		Downstream: c.downstream.Load(),
+	}
+}
+
+// limitReached returns the reason of closing the connection when a limit is
+// reached, otherwise the time when it may be reached next.
+func (c *Conn) limitReached(idle, lifetime time.Duration) (time.Time, error) {
+	now := time.Now()
+	var next time.Time
+	if lifetime > 0 {
+		next = c.start.Add(lifetime)
+		if !now.Before(next) {
+			return next, ErrMaxLifetime
+		}
+	}
+	if idle > 0 {
+		deadline := time.Unix(0, c.lastActive.Load()).Add(idle)
+		if !now.Before(deadline) {
+			return deadline, ErrIdleTimeout
+		}
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	return next, nil
+}
+
+// Wrap returns the target connection counting the bytes written to it as
+// transferred upstream and the bytes read from it as transferred downstream,
+// which makes the connection active. The target connection is closed when
+// the connection is killed.
+func (c *Conn) Wrap(conn net.Conn) net.Conn {
+	c.OnKill(func() { _ = conn.Close() })
+	return &trackedConn{Conn: conn, tracked: c}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracked *Conn
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.tracked.downstream.Add(int64(n))
+		c.tracked.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.tracked.upstream.Add(int64(n))
+		c.tracked.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection, if it is supported.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// WrapUpload returns the body of a request to the target counting the bytes
+// read from it as transferred upstream, which makes the connection active.
+func (c *Conn) WrapUpload(body io.ReadCloser) io.ReadCloser {
+	return &trackedBody{ReadCloser: body, tracked: c, counter: &c.upstream}
+}
+
+// WrapDownload returns the body of a response from the target counting
+// the bytes read from it as transferred downstream, which makes
+// the connection active.
+func (c *Conn) WrapDownload(body io.ReadCloser) io.ReadCloser {
+	return &trackedBody{ReadCloser: body, tracked: c, counter: &c.downstream}
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	tracked *Conn
+	counter *atomic.Int64
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.counter.Add(int64(n))
+		b.tracked.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package conntrack
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	first := r.Add("http", "127.0.0.1:5000", "a.test:443")
+	second := r.Add("socks", "127.0.0.1:5001", "b.test:443")
+	second.SetRoute(1, "DIRECT")
+	infos := r.List()
+	if len(infos) != 2 || infos[0].ID != first.ID() || infos[1].Target != "b.test:443" || infos[1].Rule != 1 || infos[1].Dialer != "DIRECT" {
+		t.Fatalf("Both connections should be listed in order, got %+v", infos)
+	}
+	first.Done()
+	if infos := r.List(); len(infos) != 1 || infos[0].ID != second.ID() {
+		t.Fatalf("Done connection should not be listed, got %+v", infos)
+	}
+	if r.Kill(first.ID()) {
+		t.Fatalf("Done connection should not be killed")
+	}
+}
+
+func TestConn_Kill(t *testing.T) {
+	r := NewRegistry()
+	tracked := r.Add("http", "127.0.0.1:5000", "a.test:443")
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	conn := tracked.Wrap(client)
+	go func() {
+		buf := make([]byte, 3)
+		_, _ = io.ReadFull(server, buf)
+		_, _ = server.Write([]byte("hello"))
+	}()
+	if _, err := conn.Write([]byte("hey")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if tracked.Upstream() != 3 || tracked.Downstream() != 5 {
+		t.Fatalf("Transferred bytes should be 3 up and 5 down, got %d and %d", tracked.Upstream(), tracked.Downstream())
+	}
+	called := 0
+	tracked.OnKill(func() { called++ })
+	if !r.Kill(tracked.ID()) || tracked.Err() != ErrKilled {
+		t.Fatalf("Connection should be killed")
+	}
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("Killed connection should be closed")
+	}
+	tracked.OnKill(func() { called++ })
+	if called != 2 {
+		t.Fatalf("Kill functions should be called once each, got %d calls", called)
+	}
+}
+
+func TestRegistry_Wait(t *testing.T) {
+	r := NewRegistry()
+	if !r.Wait(context.Background()) {
+		t.Fatalf("Empty registry should not be waited for")
+	}
+	tracked := r.Add("socks", "127.0.0.1:5000", "a.test:443")
+	tracked.OnKill(tracked.Done)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if r.Wait(ctx) {
+		t.Fatalf("Waiting should time out with an active connection")
+	}
+	go func() {
+		if r.KillAll() != 1 {
+			t.Errorf("Active connection should be killed")
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !r.Wait(ctx) || r.Count() != 0 {
+		t.Fatalf("Waiting should end when the connection is done, got %d connections", r.Count())
+	}
+}
+
+func TestConn_Limit(t *testing.T) {
+	r := NewRegistry()
+	tracked := r.Add("http", "127.0.0.1:5000", "a.test:443")
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	conn := tracked.Wrap(client)
+	stop := tracked.Limit(100*time.Millisecond, 0)
+	defer stop()
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Active connection should not be closed, got %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tracked.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tracked.Err() != ErrIdleTimeout {
+		t.Fatalf("Idle connection should be closed, got %v", tracked.Err())
+	}
+
+	tracked = r.Add("socks", "127.0.0.1:5001", "b.test:443")
+	defer tracked.Limit(time.Hour, 50*time.Millisecond)()
+	deadline = time.Now().Add(5 * time.Second)
+	for tracked.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tracked.Err() != ErrMaxLifetime {
+		t.Fatalf("Connection should be closed after its lifetime, got %v", tracked.Err())
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request describes a proxied connection for rule matching.
+type Request struct {
+	// normalized domain name, empty for IP literals
+	DomainName string
+	IP         *LazyIP
+	Port       uint16
+	// client address, nil when unknown
+	Client net.IP
+	// time of the request, the environment clock is used when zero
+	Time time.Time
+}
+
+// Conditions of a rule are groups of alternatives. All groups need to be
+// satisfied. A group is satisfied when some of its positive alternatives
+// match, if there are any, and none of the negated ones, written with
+// the `!` prefix, matches.
+
+func cutNegation(value string) (string, bool) {
+	return strings.CutPrefix(value, "!")
+}
+
+type portRange struct {
+	first uint16
+	last  uint16
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.first && port <= r.last
+}
+
+type portCondition struct {
+	allowed []portRange
+	denied  []portRange
+}
+
+func parsePortRange(value string) (portRange, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		last = first
+	}
+	from, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil || from == 0 {
+		return portRange{}, fmt.Errorf("invalid port `%s`", value)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil || to < from {
+		return portRange{}, fmt.Errorf("invalid port range `%s`", value)
+	}
+	return portRange{first: uint16(from), last: uint16(to)}, nil
+}
+
+func parsePortCondition(ports []string) (portCondition, error) {
+	var c portCondition
+	for i, value := range ports {
+		value, negated := cutNegation(value)
+		r, err := parsePortRange(value)
+		if err != nil {
+			return portCondition{}, fmt.Errorf("port[%d]: %w", i, err)
+		}
+		if negated {
+			c.denied = append(c.denied, r)
+		} else {
+			c.allowed = append(c.allowed, r)
+		}
+	}
+	return c, nil
+}
+
+func (c *portCondition) empty() bool {
+	return len(c.allowed) == 0 && len(c.denied) == 0
+}
+
+func (c *portCondition) accepts(port uint16) bool {
+	for _, r := range c.denied {
+		if r.contains(port) {
+			return false
+		}
+	}
+	if len(c.allowed) == 0 {
+		return true
+	}
+	for _, r := range c.allowed {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// contradictory reports whether the denied ports cover all allowed ones.
+func (c *portCondition) contradictory() bool {
+	if len(c.denied) == 0 {
+		return false
+	}
+	allowed := c.allowed
+	if len(allowed) == 0 {
+		allowed = []portRange{{first: 1, last: 65535}}
+	}
+	for _, r := range allowed {
+		for port := int(r.first); port <= int(r.last); {
+			covered := false
+			for _, d := range c.denied {
+				if d.contains(uint16(port)) {
+					port = int(d.last) + 1
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type sourceCondition struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func parseSourceNet(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("IP address or CIDR is required: %w", err)
+	}
+	return ipNet, nil
+}
+
+func parseSourceCondition(sources []string) (sourceCondition, error) {
+	var c sourceCondition
+	for i, value := range sources {
+		value, negated := cutNegation(value)
+		ipNet, err := parseSourceNet(value)
+		if err != nil {
+			return sourceCondition{}, fmt.Errorf("source[%d]: %w", i, err)
+		}
+		if negated {
+			c.denied = append(c.denied, ipNet)
+		} else {
+			c.allowed = append(c.allowed, ipNet)
+		}
+	}
+	return c, nil
+}
+
+func (c *sourceCondition) empty() bool {
+	return len(c.allowed) == 0 && len(c.denied) == 0
+}
+
+func (c *sourceCondition) accepts(client net.IP) bool {
+	if client == nil {
+		return len(c.allowed) == 0
+	}
+	for _, n := range c.denied {
+		if n.Contains(client) {
+			return false
+		}
+	}
+	if len(c.allowed) == 0 {
+		return true
+	}
+	for _, n := range c.allowed {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// contradictory reports whether each allowed network is within some denied
+// network.
+func (c *sourceCondition) contradictory() bool {
+	if len(c.allowed) == 0 || len(c.denied) == 0 {
+		return false
+	}
+	for _, a := range c.allowed {
+		if !netsCover(c.denied, a) {
+			return false
+		}
+	}
+	return true
+}
+
+func netsCover(nets []*net.IPNet, ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	for _, n := range nets {
+		nOnes, nBits := n.Mask.Size()
+		if nBits == bits && nOnes <= ones && n.Contains(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the pattern matcher a matches everything matched
+// by b. Only domain and CIDR patterns are compared.
+func covers(a, b matcher) bool {
+	switch a := a.(type) {
+	case *subdomainMatcher:
+		switch b := b.(type) {
+		case *domainMatcher:
+			return a.Matches(b.domain, nil)
+		case *subdomainMatcher:
+			return a.length == 0 || b.length > 0 && a.Matches(b.domain, nil)
+		}
+	case *domainMatcher:
+		if b, ok := b.(*domainMatcher); ok {
+			return a.domain == b.domain
+		}
+	case *cidrMatcher:
+		if b, ok := b.(*cidrMatcher); ok {
+			return netsCover([]*net.IPNet{a.cidr}, b.cidr)
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func resolveProxyAddr(env *Environment, domain string, port uint16, client string) string {
+	rule := env.ResolveProxyRule(&Request{
+		DomainName: domain,
+		IP:         StaticIP(nil),
+		Port:       port,
+		Client:     net.ParseIP(client),
+	})
+	if rule == nil {
+		return "<none>"
+	}
+	return rule.ProxyAddr()
+}
+
+func TestResolveProxyRule_NegatedPattern(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://corp.test:3128", Patterns: []string{".corp", "!public.corp"}},
+		Rule{Patterns: []string{"."}},
+	)
+	if addr := resolveProxyAddr(env, "intranet.corp", 443, ""); addr != "corp.test:3128" {
+		t.Fatalf("Domain in `.corp` should use the corp proxy, got `%s`", addr)
+	}
+	if addr := resolveProxyAddr(env, "public.corp", 443, ""); addr != "" {
+		t.Fatalf("Negated domain should fall through to the next rule, got `%s`", addr)
+	}
+	if addr := resolveProxyAddr(env, "www.public.corp", 443, ""); addr != "corp.test:3128" {
+		t.Fatalf("Subdomain of negated domain should use the corp proxy, got `%s`", addr)
+	}
+}
+
+func TestResolveProxyRule_OnlyNegatedPatterns(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", Patterns: []string{"!.local"}},
+	)
+	if addr := resolveProxyAddr(env, "the.test", 443, ""); addr != "proxy.test:3128" {
+		t.Fatalf("Rule with negated patterns only should match other domains, got `%s`", addr)
+	}
+	if addr := resolveProxyAddr(env, "", 443, ""); addr != "proxy.test:3128" {
+		t.Fatalf("Rule with negated patterns only should match IP literals, got `%s`", addr)
+	}
+	if addr := resolveProxyAddr(env, "printer.local", 443, ""); addr != "<none>" {
+		t.Fatalf("Negated domain should not match, got `%s`", addr)
+	}
+}
+
+func TestResolveProxyRule_EmptyPatternList(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", PatternURLs: []string{"https://lists.test/corp.txt"}, Ports: []string{"443"}},
+	)
+	if addr := resolveProxyAddr(env, "the.test", 443, ""); addr != "<none>" {
+		t.Fatalf("Rule with an empty pattern list should not match any domain, got `%s`", addr)
+	}
+}
+
+func TestResolveProxyRule_Ports(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", Patterns: []string{".corp"}, Ports: []string{"443", "8000-8999", "!8080"}},
+		Rule{Proxy: "http://ssh.test:3128", Ports: []string{"22"}},
+	)
+	tests := []struct {
+		domain string
+		port   uint16
+		addr   string
+	}{
+		{"a.corp", 443, "proxy.test:3128"},
+		{"a.corp", 8500, "proxy.test:3128"},
+		{"a.corp", 8080, "<none>"},
+		{"a.corp", 80, "<none>"},
+		{"a.corp", 22, "ssh.test:3128"},
+		{"the.test", 22, "ssh.test:3128"},
+		{"the.test", 443, "<none>"},
+	}
+	for _, tt := range tests {
+		if addr := resolveProxyAddr(env, tt.domain, tt.port, ""); addr != tt.addr {
+			t.Fatalf("`%s:%d` should resolve to `%s`, got `%s`", tt.domain, tt.port, tt.addr, addr)
+		}
+	}
+}
+
+func TestResolveProxyRule_Sources(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", Patterns: []string{"."}, Sources: []string{"10.0.0.0/8", "!10.0.5.0/24", "192.168.1.7"}},
+	)
+	tests := map[string]string{
+		"10.1.2.3":    "proxy.test:3128",
+		"10.0.5.3":    "<none>",
+		"192.168.1.7": "proxy.test:3128",
+		"192.168.1.8": "<none>",
+		"":            "<none>",
+	}
+	for client, expected := range tests {
+		if addr := resolveProxyAddr(env, "the.test", 443, client); addr != expected {
+			t.Fatalf("Client `%s` should resolve to `%s`, got `%s`", client, expected, addr)
+		}
+	}
+}
+
+func TestSetConfig_ContradictoryRules(t *testing.T) {
+	rules := []Rule{
+		{Patterns: []string{".corp", "!.corp"}},
+		{Patterns: []string{"a.corp", ".b.corp", "!.corp"}},
+		{Patterns: []string{"10.1.0.0/16", "!10.0.0.0/8"}},
+		{Patterns: []string{"."}, Ports: []string{"!1-1000", "!1001-65535"}},
+		{Patterns: []string{"."}, Ports: []string{"443", "!400-500"}},
+		{Patterns: []string{"."}, Sources: []string{"10.1.0.0/16", "!10.0.0.0/8"}},
+	}
+	for i, rule := range rules {
+		env := newTestEnvironment(t)
+		if err := env.SetConfig(&Config{Rules: []Rule{rule}}); err == nil || !strings.Contains(err.Error(), "can never match") {
+			t.Fatalf("Rule[%d] %+v should be rejected as contradictory, got %v", i, rule, err)
+		}
+	}
+}
+
+func TestSetConfig_InvalidConditions(t *testing.T) {
+	rules := []Rule{
+		{Patterns: []string{"!"}},
+		{Patterns: []string{"."}, Ports: []string{"0"}},
+		{Patterns: []string{"."}, Ports: []string{"http"}},
+		{Patterns: []string{"."}, Ports: []string{"10-5"}},
+		{Patterns: []string{"."}, Sources: []string{"the.test"}},
+	}
+	for i, rule := range rules {
+		env := newTestEnvironment(t)
+		if err := env.SetConfig(&Config{Rules: []Rule{rule}}); err == nil {
+			t.Fatalf("Rule[%d] %+v should be rejected", i, rule)
+		}
+	}
+}
+
+func TestSetConfig_UnreachableRules(t *testing.T) {
+	var out bytes.Buffer
+	env := NewEnvironment(NewLogger(&out, ""))
+	err := env.SetConfig(&Config{
+		Verbosity: Warn,
+		Rules: []Rule{
+			{Patterns: []string{".corp"}, Ports: []string{"443"}},
+			{Patterns: []string{".test", "10.0.0.0/8"}},
+			{Patterns: []string{"a.corp"}},
+			{Patterns: []string{"a.test", ".b.test", "10.1.0.0/16"}},
+			{Patterns: []string{"a.test", "other.domain"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	logged := out.String()
+	if !strings.Contains(logged, "rule[3] is unreachable") {
+		t.Fatalf("Rule[3] should be reported as unreachable, got: %s", logged)
+	}
+	for _, rule := range []string{"rule[0]", "rule[1]", "rule[2]", "rule[4]"} {
+		if strings.Contains(logged, rule+" is unreachable") {
+			t.Fatalf("%s should not be reported as unreachable, got: %s", rule, logged)
+		}
+	}
+}
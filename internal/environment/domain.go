@@ -0,0 +1,49 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+// UTS #46 lookup profile. Underscores are allowed, since they are common in
+// internal host names.
+var domainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+)
+
+// NormalizeDomainName converts a domain name into its canonical form used for
+// rule matching: lower-case ASCII with IDN labels in punycode and without the
+// trailing dot.
+func NormalizeDomainName(name string) (string, error) {
+	trimmed := strings.TrimSuffix(name, ".")
+	if trimmed == "" {
+		return "", nil
+	}
+	normalized, err := domainProfile.ToASCII(trimmed)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name `%s`: %w", name, err)
+	}
+	for _, label := range strings.Split(normalized, ".") {
+		if label == "" {
+			return "", fmt.Errorf("invalid domain name `%s`: empty label", name)
+		}
+		for i := 0; i < len(label); i++ {
+			if c := label[i]; !isDomainNameChar(c) {
+				return "", fmt.Errorf("invalid domain name `%s`: invalid character %q in label `%s`", name, c, label)
+			}
+		}
+	}
+	return normalized, nil
+}
+
+func isDomainNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
@@ -6,8 +6,9 @@ package environment
 
 import (
 	"fmt"
+	"github.com/psvo/flexi-proxy/internal/accesslog"
+	"golang.org/x/exp/slog"
 	"log"
-	"net"
 	"net/url"
 	"sync/atomic"
 	"time"
@@ -22,24 +23,56 @@ const (
 	Debug
 )
 
-func NewEnvironment(logger *log.Logger) *Environment {
+func NewEnvironment(logger *Logger) *Environment {
 	e := &Environment{
-		logger: logger,
-		config: &atomic.Pointer[Config]{},
+		config:       &atomic.Pointer[Config]{},
+		geoDatabases: newGeoDatabases(),
+		accessLog:    accesslog.New(),
+		clock:        time.Now,
 	}
 	e.config.Store(&Config{})
+	e.logger = slog.New(newLogHandler(logger, e.config))
 	return e
 }
 
 type Environment struct {
-	logger *log.Logger
-	config *atomic.Pointer[Config]
+	logger       *slog.Logger
+	config       *atomic.Pointer[Config]
+	geoDatabases *geoDatabases
+	accessLog    *accesslog.Log
+	clock        func() time.Time
 }
 
-func (e *Environment) WithLogger(logger *log.Logger) *Environment {
+func (e *Environment) WithLogger(logger *Logger) *Environment {
 	return &Environment{
-		logger: logger,
-		config: e.config,
+		logger:       slog.New(newLogHandler(logger, e.config)),
+		config:       e.config,
+		geoDatabases: e.geoDatabases,
+		accessLog:    e.accessLog,
+		clock:        e.clock,
+	}
+}
+
+// With returns the environment adding the attributes, given as key-value
+// pairs or slog.Attr, to its log records.
+func (e *Environment) With(args ...any) *Environment {
+	return &Environment{
+		logger:       e.logger.With(args...),
+		config:       e.config,
+		geoDatabases: e.geoDatabases,
+		accessLog:    e.accessLog,
+		clock:        e.clock,
+	}
+}
+
+// WithClock returns the environment using the clock for scheduled rules.
+func (e *Environment) WithClock(clock func() time.Time) *Environment {
+	return &Environment{
+		logger:       e.logger,
+		config:       e.config,
+		geoDatabases: e.geoDatabases,
+		accessLog:    e.accessLog,
+		clock:        clock,
 	}
 }
 
@@ -47,31 +80,47 @@ func (e *Environment) Config() *Config {
 	return e.config.Load()
 }
 
+// Logger returns a standard logger writing error records, for libraries
+// logging their errors this way.
 func (e *Environment) Logger() *log.Logger {
-	return e.logger
+	return slog.NewLogLogger(e.logger.Handler(), slog.LevelError)
 }
 
-func (e *Environment) Error(fmt string, args ...interface{}) {
-	if e.Config().Verbosity >= Error {
-		e.logger.Printf("ERROR "+fmt, args...)
-	}
+// Error logs the message with the attributes, given as key-value pairs
+// or slog.Attr, like the methods for other levels.
+func (e *Environment) Error(msg string, args ...any) {
+	e.logger.Error(msg, args...)
 }
 
-func (e *Environment) Warn(fmt string, args ...interface{}) {
-	if e.Config().Verbosity >= Warn {
-		e.logger.Printf("WARN "+fmt, args...)
-	}
+func (e *Environment) Warn(msg string, args ...any) {
+	e.logger.Warn(msg, args...)
+}
+
+func (e *Environment) Info(msg string, args ...any) {
+	e.logger.Info(msg, args...)
+}
+
+func (e *Environment) Debug(msg string, args ...any) {
+	e.logger.Debug(msg, args...)
 }
 
-func (e *Environment) Info(fmt string, args ...interface{}) {
-	if e.Config().Verbosity >= Info {
-		e.logger.Printf("INFO "+fmt, args...)
+// AccessLog writes the entry to the access log, if it is enabled.
+func (e *Environment) AccessLog(entry *accesslog.Entry) {
+	if err := e.accessLog.Write(entry); err != nil {
+		e.Warn("Writing access log failed", "error", err)
 	}
 }
 
-func (e *Environment) Debug(fmt string, args ...interface{}) {
-	if e.Config().Verbosity >= Debug {
-		e.logger.Printf("DEBUG "+fmt, args...)
+// SetVerbosity changes the verbosity of the current config. The config set
+// next replaces it.
+func (e *Environment) SetVerbosity(v int) {
+	for {
+		cfg := e.config.Load()
+		changed := *cfg
+		changed.Verbosity = verbosity(v)
+		if e.config.CompareAndSwap(cfg, &changed) {
+			return
+		}
 	}
 }
 
@@ -79,6 +128,24 @@ func (e *Environment) SetConfig(cfg *Config) error {
 	if cfg.Rules == nil {
 		return fmt.Errorf("no rules were defined")
 	}
+	if cfg.AdminListenAddr != "" && cfg.AdminToken == "" {
+		return fmt.Errorf("admin listener requires an admin token")
+	}
+	if !validLogFormat(cfg.LogFormat) {
+		return fmt.Errorf("unknown log format `%s`", cfg.LogFormat)
+	}
+	if err := cfg.accessLogConfig().Validate(); err != nil {
+		return err
+	}
+	if cfg.TunnelIdleTimeoutMillis < 0 || cfg.TunnelMaxLifetimeMillis < 0 {
+		return fmt.Errorf("tunnel limits cannot be negative")
+	}
+	geo, err := e.geoDatabases.readers(cfg)
+	if err != nil {
+		return err
+	}
+	// warnings are logged once the config, including verbosity, is in use
+	var warnings []string
 	for i := range cfg.Rules {
 		rule := &cfg.Rules[i]
 		if rule.Proxy == "" {
@@ -90,25 +157,187 @@ func (e *Environment) SetConfig(cfg *Config) error {
 			}
 			rule.url = *u
 		}
-		matchers, err := buildMatchers(rule.Patterns)
-		if err != nil {
+		if negative(rule.IdleTimeoutMillis) || negative(rule.MaxLifetimeMillis) {
+			return fmt.Errorf("rule[%d] tunnel limits cannot be negative", i)
+		}
+		rule.key = ruleKey(i, rule)
+		rule.patterns, rule.matchers = nil, nil
+		rule.negatedPatterns, rule.negated = nil, nil
+		for j, pattern := range rule.Patterns {
+			if err := rule.addPattern(pattern, geo); err != nil {
+				return fmt.Errorf("rule[%d] pattern[%d]: %w", i, j, err)
+			}
+		}
+		warnings = append(warnings, rule.compileListPatterns(i, geo)...)
+		if rule.ports, err = parsePortCondition(rule.Ports); err != nil {
+			return fmt.Errorf("rule[%d] %w", i, err)
+		}
+		if rule.sources, err = parseSourceCondition(rule.Sources); err != nil {
 			return fmt.Errorf("rule[%d] %w", i, err)
 		}
-		rule.matchers = matchers
+		if rule.schedule, err = parseScheduleCondition(rule.Schedule, rule.TimeZone); err != nil {
+			return fmt.Errorf("rule[%d] %w", i, err)
+		}
+		if reason := rule.contradiction(); reason != "" {
+			return fmt.Errorf("rule[%d] can never match: %s", i, reason)
+		}
 	}
+	cfg.index = buildRuleIndex(cfg.Rules)
+	warnings = append(warnings, cfg.unreachableRules()...)
 	e.config.Store(cfg)
+	e.accessLog.Configure(cfg.accessLogConfig())
+	for _, w := range warnings {
+		e.Warn(w)
+	}
 	return nil
 }
 
+func negative(value *int) bool {
+	return value != nil && *value < 0
+}
+
+// Clone returns a copy of the config, which SetConfig can compile without
+// changing this one, as it may be in use.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Rules = make([]Rule, len(c.Rules))
+	copy(clone.Rules, c.Rules)
+	clone.index = nil
+	return &clone
+}
+
+// unreachableRules reports rules whose patterns are all matched by earlier
+// rules, so they are never used.
+func (c *Config) unreachableRules() []string {
+	var unreachable []string
+	covering := buildCoverIndex(c.Rules)
+	for i := range c.Rules {
+		if by := c.unreachableBy(covering, i); by >= 0 {
+			unreachable = append(unreachable, fmt.Sprintf("rule[%d] is unreachable, its patterns are matched by earlier rules, e.g. rule[%d]", i, by))
+		}
+	}
+	return unreachable
+}
+
+// unreachableBy returns an earlier rule matching some of the rule's patterns,
+// if all of them are matched by earlier rules, or -1.
+func (c *Config) unreachableBy(covering *ruleIndex, i int) int {
+	rule := &c.Rules[i]
+	if len(rule.matchers) == 0 {
+		return -1
+	}
+	by := -1
+	for _, m := range rule.matchers {
+		ref := covering.covering(m)
+		if ref.rule >= i {
+			return -1
+		}
+		by = ref.rule
+	}
+	return by
+}
+
 type Config struct {
-	HttpListenAddr       string
-	SocksListenAddr      string
+	HttpListenAddr    string
+	SocksListenAddr   string
+	MetricsListenAddr string
+	// AdminListenAddr is the address of the admin API, it requires
+	// AdminToken
+	AdminListenAddr      string
+	AdminToken           string
 	ConnectTimeoutMillis int
 	ReadTimeoutMillis    int
 	WriteTimeoutMillis   int
 	KeepAliveMillis      int
-	Verbosity            verbosity
-	Rules                []Rule
+	// UpstreamMaxIdleConnections limits the idle connections kept for reuse
+	// by plain HTTP requests, zero disables reusing them, the PerHost one
+	// limits them for each target, zero for the same limit, and
+	// UpstreamIdleTimeoutMillis closes them after the time, zero for no limit
+	UpstreamMaxIdleConnections        int
+	UpstreamMaxIdleConnectionsPerHost int
+	UpstreamIdleTimeoutMillis         int
+	// TunnelIdleTimeoutMillis closes CONNECT tunnels and SOCKS sessions
+	// transferring nothing for the time, TunnelMaxLifetimeMillis closes them
+	// after the time, zero disables them
+	TunnelIdleTimeoutMillis int
+	TunnelMaxLifetimeMillis int
+	PatternRefreshMillis    int
+	// PatternCacheDir keeps the last fetched PatternURLs, used until they
+	// are fetched again, empty disables it
+	PatternCacheDir string
+	// UploadLimitKBps and DownloadLimitKBps limit the bandwidth of all
+	// connections, the Client ones limit the bandwidth of each client
+	// address, in KiB per second, zero for no limit
+	UploadLimitKBps         int
+	DownloadLimitKBps       int
+	ClientUploadLimitKBps   int
+	ClientDownloadLimitKBps int
+	// ClientConnectionsPerSecond limits new connections, including HTTP
+	// requests, of each client address, ClientMaxConnections limits their
+	// number, zero for no limit
+	ClientConnectionsPerSecond int
+	ClientMaxConnections       int
+	// MaxConnections limits the accepted connections of all listeners,
+	// HttpMaxConnections and SocksMaxConnections of each listener, except
+	// idle HTTP keep-alive ones, and DestinationMaxConnections limits tunnels and
+	// HTTP requests to each target address, zero for no limit. Connections
+	// over a limit wait for QueueTimeoutMillis, then they are rejected by
+	// 503 responses and SOCKS server failure replies. QueueMaxConnections
+	// limits the accepted connections waiting for each listener, more are
+	// rejected right away, zero for no limit.
+	MaxConnections            int
+	HttpMaxConnections        int
+	SocksMaxConnections       int
+	DestinationMaxConnections int
+	QueueTimeoutMillis        int
+	QueueMaxConnections       int
+	// ShutdownDrainMillis is how long connections may finish on shutdown
+	// before they are closed
+	ShutdownDrainMillis int
+	GeoIPDatabase       string
+	ASNDatabase         string
+	Verbosity           verbosity
+	LogFormat           string
+	// AccessLog is the path of the access log, `-` for stdout, it is
+	// rotated by AccessLogMaxSizeMB and AccessLogMaxBackups
+	AccessLog           string
+	AccessLogFormat     string
+	AccessLogMaxSizeMB  int
+	AccessLogMaxBackups int
+	// SystemProxyRules appends rules translated from HTTP_PROXY, HTTPS_PROXY,
+	// ALL_PROXY and NO_PROXY environment variables
+	SystemProxyRules bool
+	Rules            []Rule
+	index            *ruleIndex
+}
+
+func (c *Config) accessLogConfig() accesslog.Config {
+	return accesslog.Config{
+		Path:       c.AccessLog,
+		Format:     c.AccessLogFormat,
+		MaxSizeMB:  c.AccessLogMaxSizeMB,
+		MaxBackups: c.AccessLogMaxBackups,
+	}
+}
+
+// redactedSecret replaces secrets in logs and dumps of the config.
+const redactedSecret = "*****"
+
+// Redacted returns a copy of the config with secrets replaced.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.AdminToken != "" {
+		redacted.AdminToken = redactedSecret
+	}
+	return &redacted
+}
+
+// plainConfig is the config without its LogValue method.
+type plainConfig Config
+
+// LogValue keeps secrets out of logs.
+func (c *Config) LogValue() slog.Value {
+	return slog.AnyValue((*plainConfig)(c.Redacted()))
 }
 
 // possible config switching URL: detectportal.firefox.com
@@ -129,19 +358,120 @@ func (c *Config) KeepAlive() time.Duration {
 	return time.Duration(c.KeepAliveMillis) * time.Millisecond
 }
 
-func (e *Environment) ResolveProxyRule(normalizedDomainName string, ip net.IP) *Rule {
+// Bandwidth limits transfers in bytes per second, zero for no limit.
+type Bandwidth struct {
+	Upload   int
+	Download int
+}
+
+func newBandwidth(uploadKBps, downloadKBps int) Bandwidth {
+	return Bandwidth{
+		Upload:   uploadKBps * 1024,
+		Download: downloadKBps * 1024,
+	}
+}
+
+// Bandwidth returns the limits of all connections.
+func (c *Config) Bandwidth() Bandwidth {
+	return newBandwidth(c.UploadLimitKBps, c.DownloadLimitKBps)
+}
+
+// ClientBandwidth returns the limits of the connections of each client.
+func (c *Config) ClientBandwidth() Bandwidth {
+	return newBandwidth(c.ClientUploadLimitKBps, c.ClientDownloadLimitKBps)
+}
+
+// TunnelLimits returns the idle timeout and the maximum lifetime of tunnels
+// by the rule, which may be nil.
+func (c *Config) TunnelLimits(rule *Rule) (idle, lifetime time.Duration) {
+	idle = time.Duration(c.TunnelIdleTimeoutMillis) * time.Millisecond
+	lifetime = time.Duration(c.TunnelMaxLifetimeMillis) * time.Millisecond
+	if rule != nil && rule.IdleTimeoutMillis != nil {
+		idle = time.Duration(*rule.IdleTimeoutMillis) * time.Millisecond
+	}
+	if rule != nil && rule.MaxLifetimeMillis != nil {
+		lifetime = time.Duration(*rule.MaxLifetimeMillis) * time.Millisecond
+	}
+	return idle, lifetime
+}
+
+func (c *Config) PatternRefresh() time.Duration {
+	return time.Duration(c.PatternRefreshMillis) * time.Millisecond
+}
+
+func (c *Config) UpstreamIdleTimeout() time.Duration {
+	return time.Duration(c.UpstreamIdleTimeoutMillis) * time.Millisecond
+}
+
+func (c *Config) QueueTimeout() time.Duration {
+	return time.Duration(c.QueueTimeoutMillis) * time.Millisecond
+}
+
+func (c *Config) ShutdownDrain() time.Duration {
+	return time.Duration(c.ShutdownDrainMillis) * time.Millisecond
+}
+
+func (e *Environment) ResolveProxyRule(req *Request) *Rule {
+	_, rule, _ := e.MatchProxyRule(req)
+	return rule
+}
+
+// MatchProxyRule finds the rule for the request, returning also its index,
+// or -1 and nil when no rule matches, and the config of the rule, which may
+// be replaced in the environment meanwhile.
+func (e *Environment) MatchProxyRule(req *Request) (int, *Rule, *Config) {
 	cfg := e.Config()
-	for i := range cfg.Rules {
-		rule := cfg.Rules[i]
-		for j, m := range rule.matchers {
-			if m.Matches(normalizedDomainName, ip) {
-				e.Debug("rule[%d]/pattern[%d](%s) matches: %s %v", i, j, rule.Patterns[j], normalizedDomainName, ip)
-				return &rule
-			} else {
-				e.Debug("rule[%d]/pattern[%d](%s) does not match: %s %v", i, j, rule.Patterns[j], normalizedDomainName, ip)
+	i, rule := e.matchProxyRule(cfg, req, nil)
+	return i, rule, cfg
+}
+
+// matchProxyRule finds the rule for the request by the index of the rules.
+// Unless nil, the explain function receives the evaluations of the rules up
+// to the matching one.
+func (e *Environment) matchProxyRule(cfg *Config, req *Request, explain func(RuleEvaluation)) (int, *Rule) {
+	if cfg.index == nil {
+		return -1, nil
+	}
+	now := req.Time
+	if now.IsZero() {
+		now = e.clock()
+	}
+	for fromRule := 0; ; {
+		ref := cfg.index.match(req.DomainName, req.IP, fromRule)
+		if explain != nil {
+			// the index skips the rules without any matching pattern
+			skipped := ref.rule
+			if !ref.found() {
+				skipped = len(cfg.Rules)
+			}
+			for i := fromRule; i < skipped; i++ {
+				explain(RuleEvaluation{Rule: i, Proxy: cfg.Rules[i].Proxy, Reason: "no pattern matches"})
+			}
+		}
+		if !ref.found() {
+			e.Debug("No pattern matches", "target", req.DomainName, "ip", req.IP)
+			return -1, nil
+		}
+		rule := cfg.Rules[ref.rule]
+		pattern := "*"
+		if ref.pattern != anyPattern {
+			pattern = rule.patterns[ref.pattern]
+		}
+		evaluation := RuleEvaluation{Rule: ref.rule, Proxy: rule.Proxy, Pattern: pattern}
+		if ok, reason := rule.accepts(req, now); !ok {
+			e.Debug("Pattern matches, but not "+reason, "rule", ref.rule, "pattern", pattern, "target", req.DomainName, "ip", req.IP)
+			if explain != nil {
+				evaluation.Reason = "not " + reason
+				explain(evaluation)
 			}
+			fromRule = ref.rule + 1
+			continue
 		}
+		e.Debug("Pattern matches", "rule", ref.rule, "pattern", pattern, "target", req.DomainName, "ip", req.IP)
+		if explain != nil {
+			evaluation.Matched = true
+			explain(evaluation)
+		}
+		return ref.rule, &rule
 	}
-	e.Debug("no pattern matches: %s %v", normalizedDomainName, ip)
-	return nil
 }
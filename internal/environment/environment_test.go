@@ -0,0 +1,74 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func newTestEnvironment(t *testing.T, rules ...Rule) *Environment {
+	env := NewEnvironment(NewLogger(io.Discard, ""))
+	if len(rules) == 0 {
+		return env
+	}
+	if err := env.SetConfig(&Config{Rules: rules}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	return env
+}
+
+func TestResolveProxyRule_DomainBeforeLookup(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", Patterns: []string{".the.test"}},
+		Rule{Patterns: []string{"10.0.0.0/8"}},
+	)
+	ip := NewLazyIP(func() net.IP {
+		t.Fatalf("IP should not be looked up when a domain rule matches first")
+		return nil
+	})
+	rule := env.ResolveProxyRule(&Request{DomainName: "sub.the.test", IP: ip})
+	if rule.ProxyAddr() != "proxy.test:3128" {
+		t.Fatalf("Expected the domain rule to match, got %+v", rule)
+	}
+}
+
+func TestResolveProxyRule_LookupForCidr(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://proxy.test:3128", Patterns: []string{".other.test"}},
+		Rule{Proxy: "http://cidr.test:3128", Patterns: []string{"10.0.0.0/8"}},
+	)
+	lookups := 0
+	ip := NewLazyIP(func() net.IP {
+		lookups++
+		return net.ParseIP("10.1.2.3")
+	})
+	rule := env.ResolveProxyRule(&Request{DomainName: "sub.the.test", IP: ip})
+	if rule.ProxyAddr() != "cidr.test:3128" {
+		t.Fatalf("Expected the CIDR rule to match, got %+v", rule)
+	}
+	if lookups != 1 {
+		t.Fatalf("IP should be looked up once, got %d lookups", lookups)
+	}
+}
+
+func TestSetConfig_AdminToken(t *testing.T) {
+	env := newTestEnvironment(t)
+	if err := env.SetConfig(&Config{AdminListenAddr: "127.0.0.1:8004", Rules: []Rule{}}); err == nil {
+		t.Fatalf("Admin listener without a token should be rejected")
+	}
+	cfg := &Config{AdminListenAddr: "127.0.0.1:8004", AdminToken: "secret", Rules: []Rule{}}
+	if err := env.SetConfig(cfg); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	if redacted := cfg.Redacted(); redacted.AdminToken == "secret" || cfg.AdminToken != "secret" {
+		t.Fatalf("Redacted copy should hide the token, got `%s`", redacted.AdminToken)
+	}
+	env.SetVerbosity(int(Debug))
+	if v := env.Config().Verbosity; v != Debug || env.Config().AdminToken != "secret" {
+		t.Fatalf("Verbosity should be changed in the current config, got %d", v)
+	}
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+// RuleEvaluation describes whether a rule matched a request and why.
+type RuleEvaluation struct {
+	Rule  int    `json:"rule"`
+	Proxy string `json:"proxy"`
+	// the first matching positive pattern, `*` for rules without any
+	Pattern string `json:"pattern,omitempty"`
+	Matched bool   `json:"matched"`
+	// why the rule did not match
+	Reason string `json:"reason,omitempty"`
+}
+
+// ExplainProxyRule finds the rule for the request like MatchProxyRule, for
+// troubleshooting, recording the evaluation of the rules up to the matching
+// one. The rules without any matching pattern are skipped by the index of
+// the rules, so they are not evaluated.
+func (e *Environment) ExplainProxyRule(req *Request) ([]RuleEvaluation, int, *Rule) {
+	var evaluations []RuleEvaluation
+	i, rule := e.matchProxyRule(e.Config(), req, func(evaluation RuleEvaluation) {
+		evaluations = append(evaluations, evaluation)
+	})
+	return evaluations, i, rule
+}
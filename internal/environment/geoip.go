@@ -0,0 +1,180 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geoDatabase is a MaxMind DB file loaded into memory. Databases are never
+// closed, so a config being replaced can still use its database safely.
+type geoDatabase struct {
+	path    string
+	size    int64
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// geoDatabases caches loaded databases, so a file is read again only when
+// it changes.
+type geoDatabases struct {
+	mu  sync.Mutex
+	dbs map[string]*geoDatabase
+}
+
+func newGeoDatabases() *geoDatabases {
+	return &geoDatabases{
+		dbs: make(map[string]*geoDatabase),
+	}
+}
+
+func (g *geoDatabases) open(path string) (*geoDatabase, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := g.dbs[path]; ok && db.size == stat.Size() && db.modTime.Equal(stat.ModTime()) {
+		return db, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	db := &geoDatabase{
+		path:    path,
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+		reader:  reader,
+	}
+	g.dbs[path] = db
+	return db, nil
+}
+
+// geoReaders are the databases used by a single config.
+type geoReaders struct {
+	country *geoDatabase
+	asn     *geoDatabase
+}
+
+func (g *geoDatabases) readers(cfg *Config) (geoReaders, error) {
+	var readers geoReaders
+	var err error
+	if cfg.GeoIPDatabase != "" {
+		if readers.country, err = g.open(cfg.GeoIPDatabase); err != nil {
+			return geoReaders{}, fmt.Errorf("cannot load GeoIP database: %w", err)
+		}
+	}
+	if cfg.ASNDatabase != "" {
+		if readers.asn, err = g.open(cfg.ASNDatabase); err != nil {
+			return geoReaders{}, fmt.Errorf("cannot load ASN database: %w", err)
+		}
+	}
+	return readers, nil
+}
+
+// bind provides the databases to the matchers which need them.
+func (r geoReaders) bind(m matcher) error {
+	switch m := m.(type) {
+	case *geoipMatcher:
+		if r.country == nil {
+			return fmt.Errorf("GeoIPDatabase is required")
+		}
+		m.db = r.country
+	case *asnMatcher:
+		if r.asn == nil {
+			return fmt.Errorf("ASNDatabase is required")
+		}
+		m.db = r.asn
+	}
+	return nil
+}
+
+type geoipMatcher struct {
+	country string
+	db      *geoDatabase
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func (m *geoipMatcher) Matches(_ string, ip *LazyIP) bool {
+	addr := ip.Get()
+	if addr == nil || m.db == nil {
+		return false
+	}
+	var record countryRecord
+	if err := m.db.reader.Lookup(addr, &record); err != nil {
+		// e.g. IPv6 address in IPv4 only database
+		return false
+	}
+	country := record.Country.ISOCode
+	if country == "" {
+		country = record.RegisteredCountry.ISOCode
+	}
+	return country == m.country
+}
+
+type asnMatcher struct {
+	asn uint
+	db  *geoDatabase
+}
+
+type asnRecord struct {
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+func (m *asnMatcher) Matches(_ string, ip *LazyIP) bool {
+	addr := ip.Get()
+	if addr == nil || m.db == nil {
+		return false
+	}
+	var record asnRecord
+	if err := m.db.reader.Lookup(addr, &record); err != nil {
+		return false
+	}
+	return record.ASN != 0 && record.ASN == m.asn
+}
+
+func newGeoipMatcher(country string) (matcher, error) {
+	if len(country) != 2 || strings.IndexFunc(country, func(r rune) bool { return r < 'A' || r > 'Z' && r < 'a' || r > 'z' }) >= 0 {
+		return nil, fmt.Errorf("geoip pattern requires two letter country code")
+	}
+	m := geoipMatcher{
+		country: strings.ToUpper(country),
+	}
+	return &m, nil
+}
+
+func newAsnMatcher(asn string) (matcher, error) {
+	if len(asn) > 2 && strings.EqualFold(asn[:2], "AS") {
+		asn = asn[2:]
+	}
+	n, err := strconv.ParseUint(asn, 10, 32)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("asn pattern requires autonomous system number")
+	}
+	m := asnMatcher{
+		asn: uint(n),
+	}
+	return &m, nil
+}
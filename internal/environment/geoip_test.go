@@ -0,0 +1,265 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbNode is a node of the search tree of a test MaxMind DB. A leaf holds
+// the encoded data record.
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     []byte
+}
+
+// writeTestMmdb creates an IPv6 MaxMind DB, with IPv4 networks mapped
+// into ::/96, assigning records to CIDRs.
+func writeTestMmdb(t *testing.T, records map[string]map[string]interface{}) string {
+	root := &mmdbNode{}
+	for cidr, record := range records {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid CIDR `%s`: %v", cidr, err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if bits == 32 {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = encodeMmdbValue(record)
+	}
+
+	// number the inner nodes, so the root is node 0
+	var nodes []*mmdbNode
+	ids := map[*mmdbNode]int{}
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.data == nil {
+				number(c)
+			}
+		}
+	}
+	number(root)
+
+	var data bytes.Buffer
+	var tree bytes.Buffer
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, c := range n.children {
+			value := nodeCount // no data
+			if c != nil && c.data != nil {
+				value = nodeCount + 16 + data.Len()
+				data.Write(c.data)
+			} else if c != nil {
+				value = ids[c]
+			}
+			tree.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+
+	var db bytes.Buffer
+	db.Write(tree.Bytes())
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	db.Write(encodeMmdbValue(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               "Test",
+		"description":                 map[string]interface{}{},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	}))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0o644); err != nil {
+		t.Fatalf("Failed to write test database: %v", err)
+	}
+	return path
+}
+
+func encodeMmdbControl(typ int, size int) []byte {
+	if typ <= 7 {
+		return []byte{byte(typ<<5 | size)}
+	}
+	return []byte{byte(size), byte(typ - 7)}
+}
+
+func encodeMmdbValue(value interface{}) []byte {
+	var b bytes.Buffer
+	switch v := value.(type) {
+	case string:
+		b.Write(encodeMmdbControl(2, len(v)))
+		b.WriteString(v)
+	case uint16:
+		b.Write(encodeMmdbControl(5, 2))
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case uint32:
+		b.Write(encodeMmdbControl(6, 4))
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case uint64:
+		b.Write(encodeMmdbControl(9, 8))
+		_ = binary.Write(&b, binary.BigEndian, v)
+	case []interface{}:
+		b.Write(encodeMmdbControl(11, len(v)))
+		for _, item := range v {
+			b.Write(encodeMmdbValue(item))
+		}
+	case map[string]interface{}:
+		b.Write(encodeMmdbControl(7, len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.Write(encodeMmdbValue(key))
+			b.Write(encodeMmdbValue(v[key]))
+		}
+	default:
+		panic("unsupported type")
+	}
+	return b.Bytes()
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": code},
+	}
+}
+
+func asn(number uint32) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number": number,
+	}
+}
+
+func TestGeoipMatcher(t *testing.T) {
+	path := writeTestMmdb(t, map[string]map[string]interface{}{
+		"1.0.1.0/24":    country("CN"),
+		"8.8.8.0/24":    country("US"),
+		"2001:db8::/32": country("CN"),
+	})
+	env := newTestEnvironment(t)
+	err := env.SetConfig(&Config{
+		GeoIPDatabase: path,
+		Rules: []Rule{
+			{Proxy: "http://hk.test:3128", Patterns: []string{"geoip:cn"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	tests := map[string]bool{
+		"1.0.1.5":     true,
+		"8.8.8.8":     false,
+		"2001:db8::1": true,
+		"192.0.2.1":   false,
+	}
+	for ip, matches := range tests {
+		rule := env.ResolveProxyRule(&Request{IP: StaticIP(net.ParseIP(ip))})
+		if (rule != nil) != matches {
+			t.Fatalf("Pattern `geoip:cn` matching IP %s should be %v", ip, matches)
+		}
+	}
+	if rule := env.ResolveProxyRule(&Request{DomainName: "the.test", IP: StaticIP(nil)}); rule != nil {
+		t.Fatalf("Pattern `geoip:cn` should not match unresolved IP")
+	}
+}
+
+func TestAsnMatcher(t *testing.T) {
+	path := writeTestMmdb(t, map[string]map[string]interface{}{
+		"8.8.8.0/24":     asn(15169),
+		"2001:4860::/32": asn(15169),
+		"1.1.1.0/24":     asn(13335),
+	})
+	env := newTestEnvironment(t)
+	err := env.SetConfig(&Config{
+		ASNDatabase: path,
+		Rules: []Rule{
+			{Proxy: "http://egress.test:3128", Patterns: []string{"asn:AS15169"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"1.1.1.1":         false,
+		"192.0.2.1":       false,
+	}
+	for ip, matches := range tests {
+		rule := env.ResolveProxyRule(&Request{IP: StaticIP(net.ParseIP(ip))})
+		if (rule != nil) != matches {
+			t.Fatalf("Pattern `asn:AS15169` matching IP %s should be %v", ip, matches)
+		}
+	}
+}
+
+func TestGeoipMatcher_ReloadedDatabase(t *testing.T) {
+	path := writeTestMmdb(t, map[string]map[string]interface{}{
+		"1.0.1.0/24": country("CN"),
+	})
+	env := newTestEnvironment(t)
+	cfg := func() *Config {
+		return &Config{
+			GeoIPDatabase: path,
+			Rules:         []Rule{{Patterns: []string{"geoip:CN"}}},
+		}
+	}
+	if err := env.SetConfig(cfg()); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	updated := writeTestMmdb(t, map[string]map[string]interface{}{
+		"1.0.2.0/24": country("CN"),
+	})
+	if err := os.Rename(updated, path); err != nil {
+		t.Fatalf("Failed to replace database: %v", err)
+	}
+	if err := env.SetConfig(cfg()); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	if env.ResolveProxyRule(&Request{IP: StaticIP(net.ParseIP("1.0.2.1"))}) == nil {
+		t.Fatalf("Changed database should be loaded again")
+	}
+}
+
+func TestNewMatcher_Geo(t *testing.T) {
+	for _, pat := range []string{"geoip:", "geoip:CHN", "geoip:C1", "asn:", "asn:AS", "asn:x15169", "asn:0"} {
+		if _, err := newMatcher(pat); err == nil {
+			t.Fatalf("Pattern `%s` should be rejected", pat)
+		}
+	}
+	env := newTestEnvironment(t)
+	if err := env.SetConfig(&Config{Rules: []Rule{{Patterns: []string{"geoip:CN"}}}}); err == nil {
+		t.Fatalf("Pattern `geoip:CN` should require the database")
+	}
+	if err := env.SetConfig(&Config{Rules: []Rule{{Patterns: []string{"asn:1"}}}}); err == nil {
+		t.Fatalf("Pattern `asn:1` should require the database")
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strings"
+)
+
+// patternRef identifies a pattern by the index of its rule and its index
+// within the rule.
+type patternRef struct {
+	rule    int
+	pattern int
+}
+
+var noPattern = patternRef{rule: math.MaxInt, pattern: math.MaxInt}
+
+// anyPattern refers to rules without positive patterns, matching anything.
+const anyPattern = -1
+
+func (r patternRef) found() bool {
+	return r.rule != math.MaxInt
+}
+
+func (r patternRef) before(other patternRef) bool {
+	return r.rule < other.rule || r.rule == other.rule && r.pattern < other.pattern
+}
+
+// patternRefs holds the first pattern of each rule, ordered by the rule.
+type patternRefs []patternRef
+
+func (refs *patternRefs) add(ref patternRef) {
+	if n := len(*refs); n > 0 && (*refs)[n-1].rule == ref.rule {
+		if ref.before((*refs)[n-1]) {
+			(*refs)[n-1] = ref
+		}
+		return
+	}
+	*refs = append(*refs, ref)
+}
+
+// first returns the first pattern of rules starting from the given rule.
+func (refs patternRefs) first(fromRule int) patternRef {
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].rule >= fromRule })
+	if i == len(refs) {
+		return noPattern
+	}
+	return refs[i]
+}
+
+// ruleIndex is a compiled form of the configured rules. Domain patterns are
+// kept in a trie keyed by reversed labels and CIDR patterns in a binary
+// prefix tree, so a lookup does not depend on the number of rules. Any other
+// matchers are evaluated in order. The first matching pattern of the first
+// matching rule wins, as if the rules were scanned one by one.
+type ruleIndex struct {
+	domains domainNode
+	ipv4    prefixNode
+	ipv6    prefixNode
+	// cidrs holds the first CIDR pattern of each rule
+	cidrs  patternRefs
+	others []indexedMatcher
+}
+
+type indexedMatcher struct {
+	ref     patternRef
+	matcher matcher
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// patterns matching exactly this domain
+	exact patternRefs
+	// patterns matching this domain and all its subdomains
+	subtree patternRefs
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	refs     patternRefs
+}
+
+// anyMatcher stands for a rule without positive patterns.
+type anyMatcher struct{}
+
+func (m *anyMatcher) Matches(string, *LazyIP) bool {
+	return true
+}
+
+func buildRuleIndex(rules []Rule) *ruleIndex {
+	idx := &ruleIndex{}
+	for i := range rules {
+		idx.addRule(i, &rules[i])
+	}
+	return idx
+}
+
+// buildCoverIndex indexes only the rules which match whenever some of their
+// patterns match, so they hide all later rules with the same patterns.
+func buildCoverIndex(rules []Rule) *ruleIndex {
+	idx := &ruleIndex{}
+	for i := range rules {
+		if rules[i].unconditional() {
+			idx.addRule(i, &rules[i])
+		}
+	}
+	return idx
+}
+
+func (idx *ruleIndex) addRule(i int, rule *Rule) {
+	if rule.matchesAny() {
+		idx.add(patternRef{rule: i, pattern: anyPattern}, &anyMatcher{})
+		return
+	}
+	for j, m := range rule.matchers {
+		idx.add(patternRef{rule: i, pattern: j}, m)
+	}
+}
+
+func (idx *ruleIndex) add(ref patternRef, m matcher) {
+	switch m := m.(type) {
+	case *domainMatcher:
+		idx.domains.insert(m.domain).exact.add(ref)
+	case *subdomainMatcher:
+		idx.domains.insert(m.domain).subtree.add(ref)
+	case *cidrMatcher:
+		root, ip, ones := idx.prefixRoot(m.cidr)
+		if ones < 0 {
+			// never matches anything, just like the cidrMatcher
+			return
+		}
+		root.insert(ip, ones, ref)
+		idx.cidrs.add(ref)
+	default:
+		idx.others = append(idx.others, indexedMatcher{ref: ref, matcher: m})
+	}
+}
+
+func (idx *ruleIndex) prefixRoot(cidr *net.IPNet) (*prefixNode, net.IP, int) {
+	ones, bits := cidr.Mask.Size()
+	if ip4 := cidr.IP.To4(); ip4 != nil {
+		return &idx.ipv4, ip4, ones - (bits - 8*net.IPv4len)
+	}
+	return &idx.ipv6, cidr.IP, ones
+}
+
+func (n *domainNode) insert(domain string) *domainNode {
+	node := n
+	for rest := domain; rest != ""; {
+		var label string
+		label, rest = lastLabel(rest)
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			child = &domainNode{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func lastLabel(domain string) (label string, rest string) {
+	if dot := strings.LastIndexByte(domain, '.'); dot >= 0 {
+		return domain[dot+1:], domain[:dot]
+	}
+	return domain, ""
+}
+
+// lookup finds the first pattern matching the domain. With exact set to
+// false, only the subdomain patterns are considered.
+func (n *domainNode) lookup(normalizedDomainName string, exact bool, fromRule int) patternRef {
+	best := noPattern
+	if normalizedDomainName == "" && exact {
+		return best
+	}
+	node := n
+	for rest := normalizedDomainName; ; {
+		if ref := node.subtree.first(fromRule); ref.before(best) {
+			best = ref
+		}
+		if rest == "" {
+			if ref := node.exact.first(fromRule); exact && ref.before(best) {
+				best = ref
+			}
+			return best
+		}
+		var label string
+		label, rest = lastLabel(rest)
+		child, ok := node.children[label]
+		if !ok {
+			return best
+		}
+		node = child
+	}
+}
+
+func (n *prefixNode) insert(ip net.IP, ones int, ref patternRef) {
+	node := n
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	node.refs.add(ref)
+}
+
+// lookup finds the first pattern with at most the given prefix length
+// containing the IP.
+func (n *prefixNode) lookup(ip net.IP, ones int, fromRule int) patternRef {
+	best := noPattern
+	node := n
+	for i := 0; node != nil; i++ {
+		if ref := node.refs.first(fromRule); ref.before(best) {
+			best = ref
+		}
+		if i == ones {
+			break
+		}
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+	}
+	return best
+}
+
+func (idx *ruleIndex) lookupIP(addr net.IP, fromRule int) patternRef {
+	if ip4 := addr.To4(); ip4 != nil {
+		return idx.ipv4.lookup(ip4, 8*net.IPv4len, fromRule)
+	}
+	return idx.ipv6.lookup(addr, 8*net.IPv6len, fromRule)
+}
+
+// match finds the first matching pattern of rules starting from the given
+// rule. The IP address is looked up only when a CIDR pattern could win over
+// the best domain match.
+func (idx *ruleIndex) match(normalizedDomainName string, ip *LazyIP, fromRule int) patternRef {
+	best := idx.domains.lookup(normalizedDomainName, true, fromRule)
+	if idx.cidrs.first(fromRule).before(best) {
+		if addr := ip.Get(); addr != nil {
+			if ref := idx.lookupIP(addr, fromRule); ref.before(best) {
+				best = ref
+			}
+		}
+	}
+	for _, o := range idx.others {
+		if o.ref.rule < fromRule {
+			continue
+		}
+		if !o.ref.before(best) {
+			break
+		}
+		if o.matcher.Matches(normalizedDomainName, ip) {
+			best = o.ref
+			break
+		}
+	}
+	return best
+}
+
+// covering finds the first pattern which matches everything the matcher
+// matches. Only domain and CIDR patterns are considered.
+func (idx *ruleIndex) covering(m matcher) patternRef {
+	switch m := m.(type) {
+	case *domainMatcher:
+		return idx.domains.lookup(m.domain, true, 0)
+	case *subdomainMatcher:
+		return idx.domains.lookup(m.domain, false, 0)
+	case *cidrMatcher:
+		root, ip, ones := idx.prefixRoot(m.cidr)
+		if ones < 0 {
+			return noPattern
+		}
+		return root.lookup(ip, ones, 0)
+	default:
+		return noPattern
+	}
+}
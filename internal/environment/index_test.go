@@ -0,0 +1,197 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// matchLinear is the reference implementation scanning all rules in order.
+func matchLinear(rules []Rule, normalizedDomainName string, ip *LazyIP) patternRef {
+	for i := range rules {
+		for j, m := range rules[i].matchers {
+			if m.Matches(normalizedDomainName, ip) {
+				return patternRef{rule: i, pattern: j}
+			}
+		}
+	}
+	return noPattern
+}
+
+func compileRules(t testing.TB, rules []Rule) []Rule {
+	for i := range rules {
+		for _, pattern := range rules[i].Patterns {
+			if err := rules[i].addPattern(pattern, geoReaders{}); err != nil {
+				t.Fatalf("Failed to build rule[%d]: %v", i, err)
+			}
+		}
+	}
+	return rules
+}
+
+func TestRuleIndex_FirstMatchWins(t *testing.T) {
+	rules := compileRules(t, []Rule{
+		{Patterns: []string{"exact.the.test"}},
+		{Patterns: []string{"10.1.0.0/16", ".sub.the.test"}},
+		{Patterns: []string{".the.test", "10.0.0.0/8"}},
+		{Patterns: []string{"2001:db8::/32", "."}},
+	})
+	idx := buildRuleIndex(rules)
+	tests := []struct {
+		domain  string
+		ip      string
+		rule    int
+		pattern int
+	}{
+		{"exact.the.test", "10.1.2.3", 0, 0},
+		{"a.exact.the.test", "", 2, 0},
+		{"sub.the.test", "", 1, 1},
+		{"a.sub.the.test", "10.1.2.3", 1, 0},
+		{"other.the.test", "10.1.2.3", 1, 0},
+		{"other.the.test", "10.2.2.3", 2, 0},
+		{"", "10.2.2.3", 2, 1},
+		{"", "2001:db8::1", 3, 0},
+		{"else.test", "", 3, 1},
+		{"", "192.168.0.1", -1, -1},
+	}
+	for _, tt := range tests {
+		ref := idx.match(tt.domain, StaticIP(net.ParseIP(tt.ip)), 0)
+		expected := patternRef{rule: tt.rule, pattern: tt.pattern}
+		if tt.rule < 0 {
+			expected = noPattern
+		}
+		if ref != expected {
+			t.Fatalf("`%s` %s should match %+v, got %+v", tt.domain, tt.ip, expected, ref)
+		}
+	}
+}
+
+func TestRuleIndex_NoLookupWhenDomainWins(t *testing.T) {
+	rules := compileRules(t, []Rule{
+		{Patterns: []string{".the.test"}},
+		{Patterns: []string{"0.0.0.0/0"}},
+	})
+	idx := buildRuleIndex(rules)
+	ip := NewLazyIP(func() net.IP {
+		t.Fatalf("IP should not be looked up when a domain rule matches first")
+		return nil
+	})
+	if ref := idx.match("sub.the.test", ip, 0); ref.rule != 0 {
+		t.Fatalf("Expected rule[0] to match, got %+v", ref)
+	}
+}
+
+func TestRuleIndex_SameAsLinear(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	rules := compileRules(t, randomRules(rnd, 200, 5, 10))
+	idx := buildRuleIndex(rules)
+	for i := 0; i < 10_000; i++ {
+		domain, ip := randomTarget(rnd, 10)
+		expected := matchLinear(rules, domain, StaticIP(ip))
+		if ref := idx.match(domain, StaticIP(ip), 0); ref != expected {
+			t.Fatalf("`%s` %v should match %+v, got %+v", domain, ip, expected, ref)
+		}
+	}
+}
+
+// randomDomain generates a domain name from a vocabulary of the given number
+// of labels. The smaller the vocabulary, the more likely the patterns match.
+func randomDomain(rnd *rand.Rand, labels int) string {
+	domain := fmt.Sprintf("l%d", rnd.Intn(labels))
+	for n := rnd.Intn(4); n >= 0; n-- {
+		domain = fmt.Sprintf("l%d.%s", rnd.Intn(labels), domain)
+	}
+	return domain
+}
+
+// randomIP generates an IP address, IPv4 octets are limited by the spread.
+func randomIP(rnd *rand.Rand, spread int) net.IP {
+	if rnd.Intn(4) == 0 {
+		ip := make(net.IP, net.IPv6len)
+		rnd.Read(ip)
+		ip[0], ip[1], ip[2] = 0x20, 0x01, byte(rnd.Intn(spread))
+		return ip
+	}
+	if spread > 256 {
+		spread = 256
+	}
+	octet := func() byte { return byte(rnd.Intn(spread)) }
+	return net.IPv4(octet(), octet(), octet(), octet())
+}
+
+func randomPattern(rnd *rand.Rand, labels int) string {
+	switch rnd.Intn(3) {
+	case 0:
+		return randomDomain(rnd, labels)
+	case 1:
+		return "." + randomDomain(rnd, labels)
+	default:
+		ip := randomIP(rnd, labels)
+		if ip.To4() != nil {
+			return fmt.Sprintf("%s/%d", ip, 16+rnd.Intn(17))
+		}
+		return fmt.Sprintf("%s/%d", ip, 24+rnd.Intn(105))
+	}
+}
+
+func randomRules(rnd *rand.Rand, count int, patterns int, labels int) []Rule {
+	rules := make([]Rule, count)
+	for i := range rules {
+		for j := 1 + rnd.Intn(patterns); j > 0; j-- {
+			rules[i].Patterns = append(rules[i].Patterns, randomPattern(rnd, labels))
+		}
+	}
+	return rules
+}
+
+func randomTarget(rnd *rand.Rand, labels int) (string, net.IP) {
+	if rnd.Intn(3) == 0 {
+		return "", randomIP(rnd, labels)
+	}
+	return randomDomain(rnd, labels), randomIP(rnd, labels)
+}
+
+func benchmarkMatch(b *testing.B, ruleCount int, match func(rules []Rule, idx *ruleIndex, domain string, ip *LazyIP) patternRef) {
+	rnd := rand.New(rand.NewSource(1))
+	rules := compileRules(b, randomRules(rnd, ruleCount, 3, 1000))
+	idx := buildRuleIndex(rules)
+	domains := make([]string, 1024)
+	ips := make([]net.IP, len(domains))
+	for i := range domains {
+		domains[i], ips[i] = randomTarget(rnd, 1000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(domains)
+		match(rules, idx, domains[n], StaticIP(ips[n]))
+	}
+}
+
+func matchWithIndex(_ []Rule, idx *ruleIndex, domain string, ip *LazyIP) patternRef {
+	return idx.match(domain, ip, 0)
+}
+
+func matchWithScan(rules []Rule, _ *ruleIndex, domain string, ip *LazyIP) patternRef {
+	return matchLinear(rules, domain, ip)
+}
+
+func BenchmarkRuleIndex_100(b *testing.B)    { benchmarkMatch(b, 100, matchWithIndex) }
+func BenchmarkRuleIndex_10000(b *testing.B)  { benchmarkMatch(b, 10_000, matchWithIndex) }
+func BenchmarkRuleIndex_50000(b *testing.B)  { benchmarkMatch(b, 50_000, matchWithIndex) }
+func BenchmarkLinearScan_100(b *testing.B)   { benchmarkMatch(b, 100, matchWithScan) }
+func BenchmarkLinearScan_10000(b *testing.B) { benchmarkMatch(b, 10_000, matchWithScan) }
+func BenchmarkLinearScan_50000(b *testing.B) { benchmarkMatch(b, 50_000, matchWithScan) }
+
+func BenchmarkBuildRuleIndex_50000(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	rules := compileRules(b, randomRules(rnd, 50_000, 3, 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buildRuleIndex(rules)
+	}
+}
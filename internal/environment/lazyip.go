@@ -0,0 +1,78 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"golang.org/x/exp/slog"
+	"net"
+	"sync"
+)
+
+// LazyIP is the IP address of a request target which is looked up only when
+// some matcher asks for it. The result is memoized, so the lookup happens at
+// most once per request.
+type LazyIP struct {
+	mu       sync.Mutex
+	lookup   func() net.IP
+	ip       net.IP
+	resolved bool
+}
+
+func NewLazyIP(lookup func() net.IP) *LazyIP {
+	return &LazyIP{
+		lookup: lookup,
+	}
+}
+
+func StaticIP(ip net.IP) *LazyIP {
+	return &LazyIP{
+		ip:       ip,
+		resolved: true,
+	}
+}
+
+func (l *LazyIP) Get() net.IP {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.resolved {
+		if l.lookup != nil {
+			l.ip = l.lookup()
+		}
+		l.resolved = true
+	}
+	return l.ip
+}
+
+// Peek returns the address when it was already looked up, it does not
+// force the lookup.
+func (l *LazyIP) Peek() net.IP {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ip
+}
+
+// String describes the address without forcing the lookup.
+func (l *LazyIP) String() string {
+	if l == nil {
+		return "<nil>"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.resolved {
+		return "<unresolved>"
+	}
+	return l.ip.String()
+}
+
+// LogValue logs the address like String, without forcing the lookup.
+func (l *LazyIP) LogValue() slog.Value {
+	return slog.StringValue(l.String())
+}
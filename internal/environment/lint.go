@@ -0,0 +1,68 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+)
+
+// Lint reports patterns which have no effect, either because they repeat
+// another pattern of the same rule or because an earlier rule matches
+// everything they match. The config needs to be set by SetConfig first.
+func (c *Config) Lint() []string {
+	var problems []string
+	covering := buildCoverIndex(c.Rules)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		problems = append(problems, rule.duplicatePatterns(i)...)
+		for j, m := range rule.matchers {
+			ref := covering.covering(m)
+			if ref.rule < i {
+				problems = append(problems, fmt.Sprintf("rule[%d] pattern `%s` is shadowed by rule[%d] pattern `%s`", i, rule.patterns[j], ref.rule, c.Rules[ref.rule].patterns[ref.pattern]))
+			}
+		}
+	}
+	return problems
+}
+
+// duplicatePatterns reports patterns of the rule which match the same as
+// some previous one, like `a.test` and `A.test.`.
+func (r *Rule) duplicatePatterns(ruleIdx int) []string {
+	var duplicates []string
+	seen := map[string]string{}
+	check := func(prefix string, pattern string, m matcher) {
+		key := prefix + patternKey(pattern, m)
+		if first, ok := seen[key]; ok {
+			duplicates = append(duplicates, fmt.Sprintf("rule[%d] pattern `%s` is a duplicate of `%s`", ruleIdx, pattern, first))
+		} else {
+			seen[key] = pattern
+		}
+	}
+	for j, m := range r.matchers {
+		check("", r.patterns[j], m)
+	}
+	for j, m := range r.negated {
+		check("!", r.negatedPatterns[j], m)
+	}
+	return duplicates
+}
+
+// patternKey identifies what the pattern matches, regardless of its spelling.
+func patternKey(pattern string, m matcher) string {
+	switch m := m.(type) {
+	case *domainMatcher:
+		return "domain:" + m.domain
+	case *subdomainMatcher:
+		return "subdomain:" + m.domain
+	case *cidrMatcher:
+		return "cidr:" + m.cidr.String()
+	case *geoipMatcher:
+		return "geoip:" + m.country
+	case *asnMatcher:
+		return fmt.Sprintf("asn:%d", m.asn)
+	default:
+		return pattern
+	}
+}
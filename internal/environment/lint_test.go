@@ -0,0 +1,34 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"testing"
+)
+
+func TestConfigLint(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Patterns: []string{".corp", "10.0.0.0/8", "A.corp.", "a.corp"}},
+		Rule{Patterns: []string{"b.corp", "10.1.0.0/16", "other.test", "10.0.0.1/8"}},
+		Rule{Patterns: []string{".test"}, Ports: []string{"443"}},
+		Rule{Patterns: []string{"a.test", "!x.test", "!X.test"}},
+	)
+	expected := []string{
+		"rule[0] pattern `a.corp` is a duplicate of `A.corp.`",
+		"rule[1] pattern `b.corp` is shadowed by rule[0] pattern `.corp`",
+		"rule[1] pattern `10.1.0.0/16` is shadowed by rule[0] pattern `10.0.0.0/8`",
+		"rule[1] pattern `10.0.0.1/8` is shadowed by rule[0] pattern `10.0.0.0/8`",
+		"rule[3] pattern `!X.test` is a duplicate of `!x.test`",
+	}
+	problems := env.Config().Lint()
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %q", len(expected), problems)
+	}
+	for i := range expected {
+		if problems[i] != expected[i] {
+			t.Fatalf("Expected problem `%s`, got `%s`", expected[i], problems[i])
+		}
+	}
+}
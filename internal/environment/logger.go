@@ -0,0 +1,119 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"io"
+	"sync/atomic"
+)
+
+// Log formats, text is the default.
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+// Logger is the output of log records of a subsystem, like `http`. The records
+// are formatted by the config of the environment using the logger, they
+// are written as text prefixed by the subsystem or as JSON with the
+// subsystem attribute.
+type Logger struct {
+	output    io.Writer
+	subsystem string
+}
+
+func NewLogger(output io.Writer, subsystem string) *Logger {
+	return &Logger{
+		output:    output,
+		subsystem: subsystem,
+	}
+}
+
+func validLogFormat(format string) bool {
+	return format == "" || format == LogFormatText || format == LogFormatJson
+}
+
+// level is the lowest slog level logged with the verbosity.
+func (v verbosity) level() slog.Level {
+	switch {
+	case v < Error:
+		return slog.LevelError + 1
+	case v == Error:
+		return slog.LevelError
+	case v == Warn:
+		return slog.LevelWarn
+	case v == Info:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// logHandler passes records enabled by the verbosity to the text or JSON
+// handler, by the current config.
+type logHandler struct {
+	config *atomic.Pointer[Config]
+	text   slog.Handler
+	json   slog.Handler
+}
+
+func newLogHandler(logger *Logger, config *atomic.Pointer[Config]) *logHandler {
+	h := &logHandler{
+		config: config,
+		text:   slog.NewTextHandler(&prefixWriter{output: logger.output, prefix: logger.subsystem}, nil),
+		json:   slog.NewJSONHandler(logger.output, nil),
+	}
+	if logger.subsystem != "" {
+		h.json = h.json.WithAttrs([]slog.Attr{slog.String("subsystem", logger.subsystem)})
+	}
+	return h
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.config.Load().Verbosity.level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.config.Load().LogFormat == LogFormatJson {
+		return h.json.Handle(ctx, r)
+	}
+	return h.text.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{
+		config: h.config,
+		text:   h.text.WithAttrs(attrs),
+		json:   h.json.WithAttrs(attrs),
+	}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{
+		config: h.config,
+		text:   h.text.WithGroup(name),
+		json:   h.json.WithGroup(name),
+	}
+}
+
+// prefixWriter writes each record, which the text handler writes at once,
+// prefixed by the subsystem.
+type prefixWriter struct {
+	output io.Writer
+	prefix string
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if w.prefix == "" {
+		return w.output.Write(p)
+	}
+	if _, err := fmt.Fprintf(w.output, "%s %s", w.prefix, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
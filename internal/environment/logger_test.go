@@ -0,0 +1,69 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	env := NewEnvironment(NewLogger(&out, "http"))
+	if err := env.SetConfig(&Config{Verbosity: Info, Rules: []Rule{}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	env.With("client", "127.0.0.1:1234").Info("Tunnel closed", "rule", 2)
+	env.Debug("Hidden")
+	logged := out.String()
+	if !strings.HasPrefix(logged, "http time=") || !strings.Contains(logged, `level=INFO msg="Tunnel closed" client=127.0.0.1:1234 rule=2`) {
+		t.Fatalf("Text record should be prefixed by the subsystem, got: %s", logged)
+	}
+	if strings.Contains(logged, "Hidden") {
+		t.Fatalf("Debug record should not be logged with info verbosity, got: %s", logged)
+	}
+
+	out.Reset()
+	if err := env.SetConfig(&Config{Verbosity: Debug, LogFormat: LogFormatJson, Rules: []Rule{}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	env.Debug("Connecting failed", "ip", StaticIP([]byte{10, 0, 0, 1}), "error", errors.New("refused"))
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Record should be JSON, got: %s", out.String())
+	}
+	expected := map[string]interface{}{
+		"level":     "DEBUG",
+		"msg":       "Connecting failed",
+		"subsystem": "http",
+		"ip":        "10.0.0.1",
+		"error":     "refused",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Fatalf("Record should have `%s` = `%v`, got: %s", key, value, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := env.SetConfig(&Config{Verbosity: -1, Rules: []Rule{}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	env.Error("Hidden")
+	env.Logger().Print("Hidden")
+	if out.Len() > 0 {
+		t.Fatalf("Nothing should be logged with negative verbosity, got: %s", out.String())
+	}
+}
+
+func TestSetConfig_InvalidLogFormat(t *testing.T) {
+	env := NewEnvironment(NewLogger(&bytes.Buffer{}, ""))
+	if err := env.SetConfig(&Config{LogFormat: "xml", Rules: []Rule{}}); err == nil {
+		t.Fatalf("Log format `xml` should be rejected")
+	}
+}
@@ -5,17 +5,176 @@
 package environment
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type Rule struct {
-	Proxy    string
-	Patterns []string
-	url      url.URL
-	matchers []matcher
+	Proxy        string
+	Patterns     []string
+	PatternFiles []string
+	PatternURLs  []string
+	// Ports and Sources (client addresses) are additional conditions which
+	// need to be satisfied together with Patterns.
+	Ports   []string
+	Sources []string
+	// Schedule holds week days and time ranges when the rule applies,
+	// e.g. `Mon-Fri 09:00-17:00`, evaluated in TimeZone, the local time
+	// zone by default.
+	Schedule []string
+	TimeZone string
+	// IdleTimeoutMillis and MaxLifetimeMillis override the global tunnel
+	// limits for tunnels matched by the rule when they are set, zero
+	// disables them
+	IdleTimeoutMillis *int
+	MaxLifetimeMillis *int
+	// UploadLimitKBps and DownloadLimitKBps limit the bandwidth shared by
+	// all connections matched by the rule
+	UploadLimitKBps   int
+	DownloadLimitKBps int
+	url               url.URL
+	key               string
+	// listPatterns are loaded from PatternFiles and PatternURLs. Unlike
+	// Patterns, invalid entries are skipped instead of rejecting the config.
+	listPatterns    []string
+	patterns        []string
+	matchers        []matcher
+	negatedPatterns []string
+	negated         []matcher
+	ports           portCondition
+	sources         sourceCondition
+	schedule        scheduleCondition
+}
+
+// Bandwidth returns the bandwidth limits of the rule.
+func (r *Rule) Bandwidth() Bandwidth {
+	return newBandwidth(r.UploadLimitKBps, r.DownloadLimitKBps)
+}
+
+// Key identifies the rule by its index and its settings. The rule keeps it
+// in copies of the config and in reloaded configs, unless it changes.
+func (r *Rule) Key() string {
+	return r.key
+}
+
+// ruleKey hashes the settings of the rule, prefixed by its index.
+func ruleKey(i int, r *Rule) string {
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d:%x", i, sum[:8])
+}
+
+// AddListPatterns adds patterns loaded from PatternFiles and PatternURLs.
+func (r *Rule) AddListPatterns(patterns []string) {
+	r.listPatterns = append(r.listPatterns, patterns...)
+}
+
+// ListPatterns returns the patterns loaded from PatternFiles and PatternURLs.
+func (r *Rule) ListPatterns() []string {
+	return r.listPatterns
+}
+
+// addPattern adds a positive or a negated pattern to the rule.
+func (r *Rule) addPattern(pattern string, geo geoReaders) error {
+	p, negated := cutNegation(pattern)
+	m, err := newMatcher(p)
+	if err == nil {
+		err = geo.bind(m)
+	}
+	if err != nil {
+		return err
+	}
+	if negated {
+		r.negatedPatterns = append(r.negatedPatterns, pattern)
+		r.negated = append(r.negated, m)
+	} else {
+		r.patterns = append(r.patterns, pattern)
+		r.matchers = append(r.matchers, m)
+	}
+	return nil
+}
+
+// compileListPatterns adds the matchers of the list patterns, skipping
+// invalid ones.
+func (r *Rule) compileListPatterns(ruleIdx int, geo geoReaders) []string {
+	var skipped []error
+	for _, pattern := range r.listPatterns {
+		if err := r.addPattern(pattern, geo); err != nil {
+			skipped = append(skipped, fmt.Errorf("`%s`: %w", pattern, err))
+		}
+	}
+	if len(skipped) > 0 {
+		return []string{fmt.Sprintf("rule[%d] skipped %d invalid list patterns, the first one %v", ruleIdx, len(skipped), skipped[0])}
+	}
+	return nil
+}
+
+// unconditional reports whether the rule matches whenever some of its
+// positive patterns matches.
+func (r *Rule) unconditional() bool {
+	return len(r.negated) == 0 && r.ports.empty() && r.sources.empty() && r.schedule.empty()
+}
+
+// matchesAny reports whether the rule has only negated patterns or other
+// conditions, so it matches any destination satisfying them. It depends on
+// the configured pattern sources, so a rule with pattern lists never matches
+// any destination, even when the lists are empty or failed to load.
+func (r *Rule) matchesAny() bool {
+	return len(r.patterns) == 0 && len(r.PatternFiles) == 0 && len(r.PatternURLs) == 0 && !r.unconditional()
+}
+
+// accepts checks the conditions other than the positive patterns, the
+// schedule at the time of the request.
+func (r *Rule) accepts(req *Request, now time.Time) (bool, string) {
+	for j, m := range r.negated {
+		if m.Matches(req.DomainName, req.IP) {
+			return false, fmt.Sprintf("negated pattern `%s`", r.negatedPatterns[j])
+		}
+	}
+	if !r.ports.accepts(req.Port) {
+		return false, fmt.Sprintf("port %d", req.Port)
+	}
+	if !r.sources.accepts(req.Client) {
+		return false, fmt.Sprintf("source %v", req.Client)
+	}
+	if !r.schedule.accepts(now) {
+		return false, fmt.Sprintf("scheduled at %s", now.Format("Mon 15:04"))
+	}
+	return true, ""
+}
+
+// contradiction describes why the rule can never match, if so.
+func (r *Rule) contradiction() string {
+	if r.ports.contradictory() {
+		return "all ports are excluded"
+	}
+	if r.sources.contradictory() {
+		return "all sources are excluded"
+	}
+	if r.schedule.contradictory() {
+		return "all times are excluded"
+	}
+	if len(r.matchers) == 0 || len(r.negated) == 0 {
+		return ""
+	}
+	for _, m := range r.matchers {
+		covered := false
+		for _, n := range r.negated {
+			if covers(n, m) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return ""
+		}
+	}
+	return "all patterns are excluded by negated patterns"
 }
 
 func (r *Rule) ProxyScheme() string {
@@ -33,14 +192,14 @@ func (r *Rule) ProxyAddr() string {
 }
 
 type matcher interface {
-	Matches(normalizedDomainName string, ip net.IP) bool
+	Matches(normalizedDomainName string, ip *LazyIP) bool
 }
 
 type domainMatcher struct {
 	domain string
 }
 
-func (m *domainMatcher) Matches(normalizedDomainName string, _ net.IP) bool {
+func (m *domainMatcher) Matches(normalizedDomainName string, _ *LazyIP) bool {
 	return normalizedDomainName == m.domain
 }
 
@@ -49,7 +208,7 @@ type subdomainMatcher struct {
 	domain string
 }
 
-func (m *subdomainMatcher) Matches(normalizedDomainName string, _ net.IP) bool {
+func (m *subdomainMatcher) Matches(normalizedDomainName string, _ *LazyIP) bool {
 	length := len(normalizedDomainName)
 	if length > 0 {
 		if m.length == 0 {
@@ -71,14 +230,21 @@ type cidrMatcher struct {
 	cidr *net.IPNet
 }
 
-func (m *cidrMatcher) Matches(_ string, ip net.IP) bool {
-	return m.cidr.Contains(ip)
+func (m *cidrMatcher) Matches(_ string, ip *LazyIP) bool {
+	addr := ip.Get()
+	return addr != nil && m.cidr.Contains(addr)
 }
 
 func newMatcher(pattern string) (matcher, error) {
 	if ip := net.ParseIP(pattern); pattern == "" || ip != nil {
 		return nil, fmt.Errorf("domain name pattern or CIDR is required")
 	}
+	if country, ok := strings.CutPrefix(pattern, "geoip:"); ok {
+		return newGeoipMatcher(country)
+	}
+	if asn, ok := strings.CutPrefix(pattern, "asn:"); ok {
+		return newAsnMatcher(asn)
+	}
 	if strings.IndexByte(pattern, '/') >= 0 {
 		_, ipNet, err := net.ParseCIDR(pattern)
 		if err != nil {
@@ -90,14 +256,25 @@ func newMatcher(pattern string) (matcher, error) {
 		return &m, nil
 	}
 	if pattern[0] == '.' {
+		domain, err := NormalizeDomainName(pattern[1:])
+		if err != nil {
+			return nil, err
+		}
 		m := subdomainMatcher{
-			length: len(pattern) - 1,
-			domain: pattern[1:],
+			length: len(domain),
+			domain: domain,
 		}
 		return &m, nil
 	}
+	domain, err := NormalizeDomainName(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if domain == "" {
+		return nil, fmt.Errorf("domain name pattern or CIDR is required")
+	}
 	m := domainMatcher{
-		domain: pattern,
+		domain: domain,
 	}
 	return &m, nil
 }
@@ -118,15 +295,3 @@ func parseProxyUrl(proxyUrl string) (*url.URL, error) {
 	}
 	return u, nil
 }
-
-func buildMatchers(patterns []string) ([]matcher, error) {
-	matchers := make([]matcher, len(patterns))
-	for i := range patterns {
-		m, err := newMatcher(patterns[i])
-		if err != nil {
-			return nil, fmt.Errorf("pattern[%d]: %w", i, err)
-		}
-		matchers[i] = m
-	}
-	return matchers, nil
-}
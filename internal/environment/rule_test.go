@@ -112,7 +112,7 @@ func TestCidrMatcher_MatchesIPv4(t *testing.T) {
 		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
 	}
 	ip := net.ParseIP("192.168.5.10")
-	if ip == nil || !m.Matches("", ip) {
+	if ip == nil || !m.Matches("", StaticIP(ip)) {
 		t.Fatalf("CIDR matcher on `%s` should match IP `%v`", pat, ip)
 	}
 }
@@ -124,7 +124,7 @@ func TestCidrMatcher_NotMatchesIPv4(t *testing.T) {
 		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
 	}
 	ip := net.ParseIP("192.168.6.10")
-	if ip == nil || m.Matches("", ip) {
+	if ip == nil || m.Matches("", StaticIP(ip)) {
 		t.Fatalf("CIDR matcher on `%s` should not match IP `%v`", pat, ip)
 	}
 }
@@ -152,7 +152,7 @@ func TestCidrMatcher_MatchesIPv6(t *testing.T) {
 		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
 	}
 	ip := net.ParseIP("1::10")
-	if ip == nil || !m.Matches("", ip) {
+	if ip == nil || !m.Matches("", StaticIP(ip)) {
 		t.Fatalf("CIDR matcher on `%s` should match IP `%v`", pat, ip)
 	}
 }
@@ -164,7 +164,7 @@ func TestCidrMatcher_NotMatchesIPv6(t *testing.T) {
 		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
 	}
 	ip := net.ParseIP("2::10")
-	if ip == nil || m.Matches("", ip) {
+	if ip == nil || m.Matches("", StaticIP(ip)) {
 		t.Fatalf("CIDR matcher on `%s` should not match IP `%v`", pat, ip)
 	}
 }
@@ -192,3 +192,129 @@ func TestNewMatcher_Empty(t *testing.T) {
 		t.Fatalf("Pattern `%s` should be rejected", pat)
 	}
 }
+
+func TestDomainMatcher_NoLookup(t *testing.T) {
+	pat := "the.test"
+	m, err := newMatcher(pat)
+	if err != nil {
+		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
+	}
+	ip := NewLazyIP(func() net.IP {
+		t.Fatalf("Domain matcher on `%s` should not look up IP", pat)
+		return nil
+	})
+	m.Matches("the.test", ip)
+}
+
+func TestCidrMatcher_LookupOnce(t *testing.T) {
+	pat := "192.168.5.1/24"
+	m, err := newMatcher(pat)
+	if err != nil {
+		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
+	}
+	lookups := 0
+	ip := NewLazyIP(func() net.IP {
+		lookups++
+		return net.ParseIP("192.168.5.10")
+	})
+	if !m.Matches("the.test", ip) || !m.Matches("the.test", ip) {
+		t.Fatalf("CIDR matcher on `%s` should match IP `%v`", pat, ip)
+	}
+	if lookups != 1 {
+		t.Fatalf("IP should be looked up once, got %d lookups", lookups)
+	}
+}
+
+func TestCidrMatcher_FailedLookup(t *testing.T) {
+	pat := "0.0.0.0/0"
+	m, err := newMatcher(pat)
+	if err != nil {
+		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
+	}
+	ip := NewLazyIP(func() net.IP { return nil })
+	if m.Matches("the.test", ip) {
+		t.Fatalf("CIDR matcher on `%s` should not match unresolved IP", pat)
+	}
+}
+
+func TestDomainMatcher_IdnPattern(t *testing.T) {
+	pat := "bücher.example"
+	m, err := newMatcher(pat)
+	if err != nil {
+		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
+	}
+	dom := "xn--bcher-kva.example"
+	if !m.Matches(dom, nil) {
+		t.Fatalf("Domain matcher on `%s` should match `%s`", pat, dom)
+	}
+}
+
+func TestSubdomainMatcher_PunycodePattern(t *testing.T) {
+	pat := ".XN--BCHER-KVA.example."
+	m, err := newMatcher(pat)
+	if err != nil {
+		t.Fatalf("Failed to create matcher on pattern `%s`: %v", pat, err)
+	}
+	dom := "shop.xn--bcher-kva.example"
+	if !m.Matches(dom, nil) {
+		t.Fatalf("Subdomain matcher on `%s` should match `%s`", pat, dom)
+	}
+}
+
+func TestNewMatcher_InvalidLabel(t *testing.T) {
+	for _, pat := range []string{"-the.test", ".the..test", "the test", "xn--zz.test", "..."} {
+		if _, err := newMatcher(pat); err == nil {
+			t.Fatalf("Pattern `%s` should be rejected", pat)
+		}
+	}
+}
+
+func TestNormalizeDomainName(t *testing.T) {
+	tests := map[string]string{
+		"the.test":              "the.test",
+		"The.Test.":             "the.test",
+		"bücher.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"ＡＢ.test":               "ab.test",
+		"_srv.the.test":         "_srv.the.test",
+		"":                      "",
+	}
+	for name, expected := range tests {
+		normalized, err := NormalizeDomainName(name)
+		if err != nil {
+			t.Fatalf("Failed to normalize `%s`: %v", name, err)
+		}
+		if normalized != expected {
+			t.Fatalf("Domain name `%s` should normalize to `%s`, got `%s`", name, expected, normalized)
+		}
+	}
+}
+
+func TestRule_Key(t *testing.T) {
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://a.test:3128", Patterns: []string{".corp"}, UploadLimitKBps: 100},
+		Rule{Patterns: []string{"."}},
+	)
+	key := env.Config().Rules[0].Key()
+	env.SetVerbosity(int(Debug))
+	if same := env.Config().Rules[0].Key(); same != key {
+		t.Fatalf("Rule key should not change with the verbosity, got `%s` and `%s`", key, same)
+	}
+	if err := env.SetConfig(env.Config().Clone()); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	if same := env.Config().Rules[0].Key(); same != key {
+		t.Fatalf("Rule key should not change in a copy of the config, got `%s` and `%s`", key, same)
+	}
+	changed := env.Config().Clone()
+	changed.Rules[0].UploadLimitKBps = 200
+	if err := env.SetConfig(changed); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	if other := env.Config().Rules[0].Key(); other == key {
+		t.Fatalf("Rule key should change with the rule")
+	}
+	if env.Config().Rules[0].Key() == env.Config().Rules[1].Key() {
+		t.Fatalf("Rules should have distinct keys")
+	}
+}
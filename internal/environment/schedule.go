@@ -0,0 +1,200 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+// timeWindow is a set of week days with a time range, e.g.
+// `Mon-Fri 09:00-17:00`. A time range ending before its start spans
+// midnight and continues on the following day.
+type timeWindow struct {
+	days [7]bool
+	from int
+	to   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekday parses the abbreviation or the full name of a week day, in
+// any case.
+func parseWeekday(value string) (time.Weekday, error) {
+	name := strings.ToLower(value)
+	if day, ok := weekdays[name]; ok {
+		return day, nil
+	}
+	if len(name) > 3 {
+		if day, ok := weekdays[name[:3]]; ok && strings.ToLower(day.String()) == name {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid week day `%s`", value)
+}
+
+func parseWeekdays(value string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := parseWeekday(first)
+		if err != nil {
+			return days, err
+		}
+		to, err := parseWeekday(last)
+		if err != nil {
+			return days, err
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || n != 2 || len(value) != 5 {
+		return 0, fmt.Errorf("invalid time `%s`, HH:MM is required", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > minutesPerDay {
+		return 0, fmt.Errorf("invalid time `%s`", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+func parseTimeWindow(value string) (timeWindow, error) {
+	w := timeWindow{
+		days: [7]bool{true, true, true, true, true, true, true},
+		from: 0,
+		to:   minutesPerDay,
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return timeWindow{}, fmt.Errorf("invalid schedule `%s`, `[days] [HH:MM-HH:MM]` is required", value)
+	}
+	if len(fields) == 2 || !strings.Contains(fields[0], ":") {
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return timeWindow{}, err
+		}
+		w.days = days
+		fields = fields[1:]
+	}
+	if len(fields) == 1 {
+		first, last, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return timeWindow{}, fmt.Errorf("invalid time range `%s`", fields[0])
+		}
+		var err error
+		if w.from, err = parseTimeOfDay(first); err != nil {
+			return timeWindow{}, err
+		}
+		if w.to, err = parseTimeOfDay(last); err != nil {
+			return timeWindow{}, err
+		}
+		if w.from == w.to || w.from == minutesPerDay {
+			return timeWindow{}, fmt.Errorf("invalid time range `%s`", fields[0])
+		}
+	}
+	return w, nil
+}
+
+// contains checks the week day and time of day of the local time.
+func (w *timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from < w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	return w.days[day] && minute >= w.from || w.days[(day+6)%7] && minute < w.to
+}
+
+type scheduleCondition struct {
+	location *time.Location
+	allowed  []timeWindow
+	denied   []timeWindow
+}
+
+func parseScheduleCondition(schedule []string, timeZone string) (scheduleCondition, error) {
+	c := scheduleCondition{
+		location: time.Local,
+	}
+	if timeZone != "" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return scheduleCondition{}, fmt.Errorf("invalid time zone: %w", err)
+		}
+		c.location = location
+	}
+	for i, value := range schedule {
+		value, negated := cutNegation(value)
+		w, err := parseTimeWindow(value)
+		if err != nil {
+			return scheduleCondition{}, fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+		if negated {
+			c.denied = append(c.denied, w)
+		} else {
+			c.allowed = append(c.allowed, w)
+		}
+	}
+	return c, nil
+}
+
+func (c *scheduleCondition) empty() bool {
+	return len(c.allowed) == 0 && len(c.denied) == 0
+}
+
+func (c *scheduleCondition) accepts(t time.Time) bool {
+	t = t.In(c.location)
+	for i := range c.denied {
+		if c.denied[i].contains(t) {
+			return false
+		}
+	}
+	if len(c.allowed) == 0 {
+		return true
+	}
+	for i := range c.allowed {
+		if c.allowed[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// contradictory reports whether no minute of a week is accepted.
+func (c *scheduleCondition) contradictory() bool {
+	if len(c.denied) == 0 {
+		return false
+	}
+	// a week starting on Monday, in UTC to avoid DST gaps
+	week := time.Date(2023, time.January, 2, 0, 0, 0, 0, time.UTC)
+	probe := scheduleCondition{location: time.UTC, allowed: c.allowed, denied: c.denied}
+	for minute := 0; minute < 7*minutesPerDay; minute++ {
+		if probe.accepts(week.Add(time.Duration(minute) * time.Minute)) {
+			return false
+		}
+	}
+	return true
+}
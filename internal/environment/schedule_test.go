@@ -0,0 +1,124 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package environment
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	// 2023-01-02 is Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2023, time.January, 1+day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		schedule string
+		time     time.Time
+		expected bool
+	}{
+		{"Mon-Fri 09:00-17:00", at(1, 9, 0), true},
+		{"Mon-Fri 09:00-17:00", at(5, 16, 59), true},
+		{"Mon-Fri 09:00-17:00", at(5, 17, 0), false},
+		{"Mon-Fri 09:00-17:00", at(6, 10, 0), false},
+		{"sat,sun", at(0, 23, 59), true},
+		{"sat,sun", at(1, 0, 0), false},
+		{"Fri-Mon", at(3, 12, 0), false},
+		{"Fri-Mon", at(1, 12, 0), true},
+		{"Saturday", at(6, 12, 0), true},
+		{"MONDAY-tuesday", at(2, 12, 0), true},
+		{"08:00-24:00", at(3, 23, 59), true},
+		{"08:00-24:00", at(3, 7, 59), false},
+		{"Fri 22:00-06:00", at(5, 23, 0), true},
+		{"Fri 22:00-06:00", at(6, 5, 59), true},
+		{"Fri 22:00-06:00", at(6, 6, 0), false},
+		{"Fri 22:00-06:00", at(5, 5, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.schedule)
+		if err != nil {
+			t.Fatalf("Failed to parse `%s`: %v", tt.schedule, err)
+		}
+		if w.contains(tt.time) != tt.expected {
+			t.Fatalf("Schedule `%s` containing %s should be %v", tt.schedule, tt.time.Format(time.RFC1123), tt.expected)
+		}
+	}
+}
+
+func TestParseTimeWindow_Invalid(t *testing.T) {
+	for _, schedule := range []string{"", "Mo", "Mon-", "Monxyz", "Sunshine", "Tues", "Mon-Fridays", "Mon 9:00-17:00", "Mon 09:00", "09:00-09:00", "24:00-01:00", "10:60-11:00", "Mon 09:00-17:00 UTC"} {
+		if _, err := parseTimeWindow(schedule); err == nil {
+			t.Fatalf("Schedule `%s` should be rejected", schedule)
+		}
+	}
+}
+
+func TestResolveProxyRule_Schedule(t *testing.T) {
+	var now time.Time
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://office.test:3128", Patterns: []string{"."}, Schedule: []string{"Mon-Fri 09:00-17:00", "!Wed 12:00-13:00"}, TimeZone: "Europe/Prague"},
+		Rule{Patterns: []string{"."}},
+	).WithClock(func() time.Time { return now })
+	tests := []struct {
+		time string
+		addr string
+	}{
+		{"2023-01-02T08:30:00Z", "office.test:3128"},
+		{"2023-01-02T07:59:00Z", ""},
+		{"2023-01-04T11:30:00Z", ""},
+		{"2023-01-04T12:00:00Z", "office.test:3128"},
+		// summer time
+		{"2023-07-03T07:30:00Z", "office.test:3128"},
+		{"2023-07-03T15:00:00Z", ""},
+		{"2023-01-07T10:00:00Z", ""},
+	}
+	for _, tt := range tests {
+		var err error
+		if now, err = time.Parse(time.RFC3339, tt.time); err != nil {
+			t.Fatalf("Invalid time `%s`: %v", tt.time, err)
+		}
+		if addr := resolveProxyAddr(env, "the.test", 443, ""); addr != tt.addr {
+			t.Fatalf("At %s should resolve to `%s`, got `%s`", tt.time, tt.addr, addr)
+		}
+	}
+}
+
+func TestResolveProxyRule_KeepsRequestTime(t *testing.T) {
+	now := time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)
+	env := newTestEnvironment(t,
+		Rule{Proxy: "http://office.test:3128", Patterns: []string{"."}, Schedule: []string{"Mon 09:00-17:00"}, TimeZone: "UTC"},
+	).WithClock(func() time.Time { return now })
+	req := &Request{DomainName: "the.test", IP: StaticIP(nil), Port: 443}
+	if rule := env.ResolveProxyRule(req); rule == nil || rule.ProxyAddr() != "office.test:3128" {
+		t.Fatalf("Request should be resolved by the clock, got %+v", rule)
+	}
+	if !req.Time.IsZero() {
+		t.Fatalf("Request time should not be changed, got %s", req.Time)
+	}
+	req.Time = now.Add(24 * time.Hour)
+	if rule := env.ResolveProxyRule(req); rule != nil {
+		t.Fatalf("Request time should take precedence over the clock, got %+v", rule)
+	}
+}
+
+func TestSetConfig_InvalidSchedule(t *testing.T) {
+	rules := []Rule{
+		{Patterns: []string{"."}, Schedule: []string{"Mon 9-17"}},
+		{Patterns: []string{"."}, Schedule: []string{"Monxyz 09:00-17:00"}},
+		{Patterns: []string{"."}, Schedule: []string{"Mon"}, TimeZone: "Nowhere/City"},
+	}
+	for i, rule := range rules {
+		env := newTestEnvironment(t)
+		if err := env.SetConfig(&Config{Rules: []Rule{rule}}); err == nil {
+			t.Fatalf("Rule[%d] %+v should be rejected", i, rule)
+		}
+	}
+	env := newTestEnvironment(t)
+	err := env.SetConfig(&Config{Rules: []Rule{{Patterns: []string{"."}, Schedule: []string{"Mon-Fri", "!Mon-Thu", "!Fri"}}}})
+	if err == nil || !strings.Contains(err.Error(), "can never match") {
+		t.Fatalf("Rule with excluded schedule should be rejected as contradictory, got %v", err)
+	}
+}
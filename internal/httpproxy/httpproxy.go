@@ -5,149 +5,373 @@
 package httpproxy
 
 import (
+	"bufio"
 	"context"
-	"fmt"
+	"errors"
+	"github.com/psvo/flexi-proxy/internal/accesslog"
+	"github.com/psvo/flexi-proxy/internal/conntrack"
 	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
 	"github.com/psvo/flexi-proxy/internal/proxy"
 	"github.com/things-go/go-socks5/bufferpool"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"strings"
 	"sync"
+	"time"
 )
 
+// listenerName labels the metrics of the HTTP proxy.
+const listenerName = "http"
+
+type ctxConnKey struct{}
+
 type myHandler struct {
 	env        *environment.Environment
+	conns      *conntrack.Registry
+	limiter    *proxy.Limiter
+	transports *transportPool
 	bufferPool bufferpool.BufPool
-	resolver   net.Resolver
 }
 
 func (h *myHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	defer func() {
 		_ = req.Body.Close()
 	}()
-	var err error
+	// the connection released its slot while it was idle
+	conn, _ := req.Context().Value(ctxConnKey{}).(net.Conn)
+	if err := proxy.ActivateConn(req.Context(), conn); err != nil {
+		target := req.URL.String()
+		if req.Method == http.MethodConnect {
+			target = req.RequestURI
+		}
+		res.Header().Set("Connection", "close")
+		env := h.env.With("client", req.RemoteAddr, "method", req.Method, "target", target)
+		h.reject(env, res, newAccessEntry(req, target), http.StatusServiceUnavailable, err)
+		return
+	}
 	if req.Method == http.MethodConnect {
 		h.handleConnectRequest(res, req)
 	} else {
 		h.handleHttpRequest(res, req)
 	}
-	if err != nil {
-		h.env.Error("bad request: %s", err)
-		res.WriteHeader(http.StatusBadGateway)
+}
+
+// newAccessEntry starts the access log entry of the request.
+func newAccessEntry(req *http.Request, target string) *accesslog.Entry {
+	return &accesslog.Entry{
+		Start:     time.Now(),
+		Listener:  listenerName,
+		Client:    req.RemoteAddr,
+		Method:    req.Method,
+		Target:    target,
+		Protocol:  req.Proto,
+		Rule:      -1,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
 	}
 }
 
+// admit admits the request by the client limits, a rejected request is
+// responded and logged. The returned function releases the admitted request.
+func (h *myHandler) admit(res http.ResponseWriter, req *http.Request, entry *accesslog.Entry) (release func(), ok bool) {
+	release, err := h.limiter.Admit(h.env.Config(), req.RemoteAddr)
+	if err == nil {
+		return release, true
+	}
+	env := h.env.With("client", req.RemoteAddr, "method", req.Method, "target", entry.Target)
+	h.reject(env, res, entry, http.StatusTooManyRequests, err)
+	return nil, false
+}
+
+// acquire takes a slot for the request to the target, waiting when
+// the target has too many connections. A request rejected after the wait is
+// responded and logged. The returned function releases the slot.
+func (h *myHandler) acquire(env *environment.Environment, res http.ResponseWriter, req *http.Request, entry *accesslog.Entry, target proxy.Target) (release func(), ok bool) {
+	release, err := h.limiter.AcquireDestination(req.Context(), h.env.Config(), target.String())
+	if err == nil {
+		return release, true
+	}
+	h.reject(env, res, entry, http.StatusServiceUnavailable, err)
+	return nil, false
+}
+
+// reject responds to the request rejected by a limit.
+func (h *myHandler) reject(env *environment.Environment, res http.ResponseWriter, entry *accesslog.Entry, status int, err error) {
+	env.Warn("Connection rejected", "error", err)
+	metrics.ConnectionRejected(listenerName, err.(*proxy.Rejection).Reason)
+	res.WriteHeader(status)
+	entry.Record(h.env, status, err)
+}
+
 func (h *myHandler) handleConnectRequest(res http.ResponseWriter, req *http.Request) {
-	addr := req.RequestURI
-	dialer := h.resolveDialer(addr)
-	h.env.Info("%s %s => %s",
-		req.Method, req.RequestURI, dialer,
-	)
-	targetConn, err := dialer.Dial(req.Context(), "tcp", addr)
+	entry := newAccessEntry(req, req.RequestURI)
+	start := entry.Start
+	release, ok := h.admit(res, req, entry)
+	if !ok {
+		return
+	}
+	defer release()
+	tracked := h.conns.Add(listenerName, req.RemoteAddr, req.RequestURI)
+	defer tracked.Done()
+	env := h.env.With("conn", tracked.ID(), "client", req.RemoteAddr, "method", req.Method, "target", req.RequestURI)
+	target, err := proxy.ParseTarget(req.RequestURI, "")
 	if err != nil {
-		h.env.Error("%s %s => %s", req.Method, req.RequestURI, err)
+		env.Warn("Invalid target", "error", err)
+		res.WriteHeader(http.StatusBadRequest)
+		entry.Record(h.env, http.StatusBadRequest, err)
+		return
+	}
+	route := proxy.ResolveRoute(h.env, target, req.RemoteAddr)
+	metrics.RuleHit(route.Rule)
+	entry.Rule, entry.Dialer = route.Rule, route.Dialer.String()
+	tracked.SetRoute(entry.Rule, entry.Dialer)
+	env = env.With(route.LogAttrs()...)
+	releaseSlot, ok := h.acquire(env, res, req, entry, target)
+	if !ok {
+		return
+	}
+	defer releaseSlot()
+	env.Debug("Connecting")
+	targetConn, err := route.Dialer.Dial(req.Context(), "tcp", target.String())
+	if err != nil {
+		env.Error("Connecting failed", "duration", time.Since(start), "error", err)
 		res.WriteHeader(http.StatusBadGateway)
+		entry.Record(h.env, http.StatusBadGateway, err)
 		return
 	}
 	defer func() { _ = targetConn.Close() }()
+	// killing the tunnel stops waiting for the bandwidth limits
+	shapeCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracked.OnKill(cancel)
+	targetConn = h.limiter.Shape(shapeCtx, route, req.RemoteAddr, tracked.Wrap(targetConn))
 	clientConn, rw, err := (res.(http.Hijacker)).Hijack()
 	if err != nil {
-		h.logError(dialer, req.Method, req.RequestURI, fmt.Errorf("forwarding setup failed"))
+		env.Error("Forwarding setup failed", "error", err)
 		res.WriteHeader(http.StatusBadGateway)
+		entry.Record(h.env, http.StatusBadGateway, err)
 		return
 	}
 	defer func() { _ = clientConn.Close() }()
+	tracked.OnKill(func() { _ = clientConn.Close() })
 	_, err = rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
 	if err != nil {
-		h.logError(dialer, req.Method, req.RequestURI, fmt.Errorf("writing response failed"))
+		env.Error("Writing response failed", "error", err)
 	}
 	err = rw.Flush()
 	if err != nil {
-		h.logError(dialer, req.Method, req.RequestURI, fmt.Errorf("flushing response failed"))
+		env.Error("Flushing response failed", "error", err)
 	}
 
-	doProxy := func(wg *sync.WaitGroup, dst io.Writer, src io.Reader) {
+	defer tracked.Limit(route.IdleTimeout, route.MaxLifetime)()
+	var errs [2]error
+	// the direction which ended first tells which side closed the tunnel
+	ended := make(chan string, 2)
+	doProxy := func(wg *sync.WaitGroup, dst io.Writer, src io.Reader, direction string, n *int64, err *error) {
 		defer wg.Done()
-		err := h.proxy(dst, src)
-		if err != nil {
-			h.logError(dialer, req.Method, req.RequestURI, fmt.Errorf("proxy tunnel error: %w", err))
+		*n, *err = h.proxy(dst, src, direction)
+		ended <- direction
+		// closing by the registry breaks the copying
+		if *err != nil && tracked.Err() == nil {
+			env.Error("Proxy tunnel error", "direction", direction, "error", *err)
 		}
 	}
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
-	go doProxy(wg, targetConn, rw)
-	go doProxy(wg, clientConn, targetConn)
+	go doProxy(wg, targetConn, rw, metrics.Upstream, &entry.Upstream, &errs[0])
+	go doProxy(wg, clientConn, targetConn, metrics.Downstream, &entry.Downstream, &errs[1])
 	wg.Wait()
-}
-
-func (h *myHandler) logError(dialer proxy.Dialer, method, uri string, err error) {
-	h.env.Error("%s %s => %s: %v", method, uri, dialer, err)
+	if errs[0] == nil {
+		errs[0] = errs[1]
+	}
+	closed := tracked.Err()
+	reason := proxy.TunnelCloseReason(closed, errs[0], <-ended)
+	attrs := append(proxy.TransferAttrs(start, entry.Upstream, entry.Downstream), "reason", reason)
+	if closed == conntrack.ErrKilled {
+		env.Warn("Tunnel closed", attrs...)
+	} else {
+		env.Info("Tunnel closed", attrs...)
+	}
+	if closed != nil {
+		errs[0] = closed
+	}
+	entry.Record(h.env, http.StatusOK, errs[0])
 }
 
 func (h *myHandler) handleHttpRequest(res http.ResponseWriter, req *http.Request) {
-	dialer := h.resolveDialer(req.URL.Host)
-	h.env.Info("%s %s => %s", req.Method, req.URL, dialer)
+	entry := newAccessEntry(req, req.URL.String())
+	start := entry.Start
+	release, ok := h.admit(res, req, entry)
+	if !ok {
+		return
+	}
+	defer release()
+	tracked := h.conns.Add(listenerName, req.RemoteAddr, req.URL.String())
+	defer tracked.Done()
+	env := h.env.With("conn", tracked.ID(), "client", req.RemoteAddr, "method", req.Method, "target", req.URL.String())
+	target, err := proxy.ParseTarget(req.URL.Host, req.URL.Scheme)
+	if err != nil {
+		env.Warn("Invalid target", "error", err)
+		res.WriteHeader(http.StatusBadRequest)
+		entry.Record(h.env, http.StatusBadRequest, err)
+		return
+	}
+	route := proxy.ResolveRoute(h.env, target, req.RemoteAddr)
+	metrics.RuleHit(route.Rule)
+	entry.Rule, entry.Dialer = route.Rule, route.Dialer.String()
+	tracked.SetRoute(entry.Rule, entry.Dialer)
+	env = env.With(route.LogAttrs()...)
+	releaseSlot, ok := h.acquire(env, res, req, entry, target)
+	if !ok {
+		return
+	}
+	defer releaseSlot()
+	env.Debug("Forwarding")
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	tracked.OnKill(cancel)
+	// the upstream connections outlive the request, so the bodies are
+	// counted and shaped instead
+	shaper := h.limiter.Shaper(ctx, route, req.RemoteAddr)
+	req.Body = shaper.Upload(tracked.WrapUpload(req.Body))
+	transport, done := h.transports.get(route.Config, route.Dialer)
+	defer done()
+	var failure error
 	rp := httputil.ReverseProxy{
-		Rewrite:  func(*httputil.ProxyRequest) { /* noop */ },
-		ErrorLog: h.env.Logger(),
-		Transport: &http.Transport{
-			Proxy:       nil,
-			DialContext: dialer.Dial,
+		Rewrite: func(*httputil.ProxyRequest) { /* noop */ },
+		ModifyResponse: func(res *http.Response) error {
+			res.Body = shaper.Download(tracked.WrapDownload(res.Body))
+			return nil
 		},
+		ErrorHandler: func(res http.ResponseWriter, _ *http.Request, err error) {
+			failure = err
+			res.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog:  env.Logger(),
+		Transport: transport,
 	}
-	rp.ServeHTTP(res, req)
-}
-
-func (h *myHandler) resolveDialer(addr string) proxy.Dialer {
-	parts := strings.SplitN(addr, ":", 2)
-	host := parts[0]
-	ip := net.ParseIP(host)
-	if ip == nil {
-		ctx, cancel := context.WithTimeout(context.Background(), h.env.Config().ConnectTimeout())
-		defer cancel()
-		ips, err := h.resolver.LookupIP(ctx, "ip", host)
-		if err != nil {
-			h.env.Warn("IP lookup failed: %v", err)
-		} else {
-			ip = ips[0]
-		}
-	} else {
-		host = ""
+	recorder := &statusRecorder{ResponseWriter: res}
+	rp.ServeHTTP(recorder, req.WithContext(ctx))
+	entry.Upstream, entry.Downstream = tracked.Upstream(), tracked.Downstream()
+	if closed := tracked.Err(); failure != nil && closed != nil {
+		failure = closed
+	}
+	defer entry.Record(h.env, recorder.status(), failure)
+	attrs := proxy.TransferAttrs(start, entry.Upstream, entry.Downstream)
+	if failure != nil {
+		env.Error("Forwarding failed", append(attrs, "error", failure)...)
+		return
 	}
-	return proxy.ResolveDialer(h.env, host, ip)
+	env.Info("Request forwarded", attrs...)
+}
+
+// statusRecorder records the final status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// informational responses precede the final one
+	if r.code == 0 && code >= http.StatusOK {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to flushing.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
 }
 
 type closeWriter interface {
 	CloseWrite() error
 }
 
-func (h *myHandler) proxy(dst io.Writer, src io.Reader) error {
+// proxy copies the data from src to dst, counting them as transferred
+// in the direction.
+func (h *myHandler) proxy(dst io.Writer, src io.Reader, direction string) (int64, error) {
 	buf := h.bufferPool.Get()
 	defer h.bufferPool.Put(buf)
-	_, err := io.CopyBuffer(dst, src, buf[:cap(buf)])
+	n, err := io.CopyBuffer(dst, metrics.CountingReader(src, listenerName, direction), buf[:cap(buf)])
 	if tcpConn, ok := dst.(closeWriter); ok {
 		_ = tcpConn.CloseWrite()
 	}
-	return err
+	return n, err
+}
+
+func maxConnections(cfg *environment.Config) int {
+	return cfg.HttpMaxConnections
+}
+
+// rejectConn responds to the connection rejected by the listener limits,
+// after reading the request head, unless the client is too slow to send it.
+func rejectConn(conn net.Conn) {
+	_, _ = http.ReadRequest(bufio.NewReader(conn))
+	_, _ = io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
 }
 
-func ListenAndServe(env *environment.Environment) error {
+// ListenAndServe serves the HTTP proxy, tracking its connections in
+// the registry and limiting them by the limiter. It stops accepting
+// connections when the context is done, active requests and tunnels are left
+// to the registry to drain.
+func ListenAndServe(ctx context.Context, env *environment.Environment, conns *conntrack.Registry, limiter *proxy.Limiter) error {
 	cfg := env.Config()
 	addr := cfg.HttpListenAddr
+	transports := newTransportPool()
 	server := &http.Server{
 		Addr: addr,
 		Handler: &myHandler{
 			env:        env,
+			conns:      conns,
+			limiter:    limiter,
+			transports: transports,
 			bufferPool: bufferpool.NewPool(32 * 1024),
 		},
 		ReadTimeout:    cfg.ReadTimeout(),
 		WriteTimeout:   cfg.WriteTimeout(),
 		MaxHeaderBytes: 16 * 1024,
 		ErrorLog:       env.Logger(),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, ctxConnKey{}, conn)
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateIdle {
+				proxy.IdleConn(conn)
+			}
+		},
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	env.Info("Listening", "url", "http://"+addr)
+	go func() {
+		<-ctx.Done()
+		env.Info("Stopped listening")
+		// closes idle connections, Serve returns right away
+		_ = server.Shutdown(context.Background())
+		transports.closeIdle()
+	}()
+	err = server.Serve(limiter.LimitListener(env, metrics.CountConnections(l, listenerName), listenerName, maxConnections, rejectConn))
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
-	env.Info("listening on: http://%s", addr)
-	return server.ListenAndServe()
+	return err
 }
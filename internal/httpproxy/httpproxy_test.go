@@ -0,0 +1,32 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRejectConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go func() {
+		rejectConn(server)
+		_ = server.Close()
+	}()
+	if _, err := io.WriteString(client, "CONNECT a.test:443 HTTP/1.1\r\nHost: a.test:443\r\n\r\n"); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || !res.Close {
+		t.Fatalf("Rejected connection should get 503 and be closed, got %d close=%v", res.StatusCode, res.Close)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package httpproxy
+
+import (
+	"context"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transportPool keeps a transport for each dialer of plain HTTP requests,
+// so their keep-alive connections are reused. A transport is retired when
+// its dialer is no longer used by the config or when the settings it was
+// created with change. Its connections are closed once its requests finish.
+type transportPool struct {
+	mu         sync.Mutex
+	cfg        *environment.Config
+	settings   transportSettings
+	transports map[string]*pooledTransport
+}
+
+// transportSettings are the settings of the config a transport and its
+// dialer are created with.
+type transportSettings struct {
+	connectTimeout time.Duration
+	keepAlive      time.Duration
+	maxIdle        int
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+}
+
+func newTransportSettings(cfg *environment.Config) transportSettings {
+	return transportSettings{
+		connectTimeout: cfg.ConnectTimeout(),
+		keepAlive:      cfg.KeepAlive(),
+		maxIdle:        cfg.UpstreamMaxIdleConnections,
+		maxIdlePerHost: cfg.UpstreamMaxIdleConnectionsPerHost,
+		idleTimeout:    cfg.UpstreamIdleTimeout(),
+	}
+}
+
+type pooledTransport struct {
+	*http.Transport
+	// active counts the requests using the transport
+	active  int
+	retired bool
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{
+		transports: map[string]*pooledTransport{},
+	}
+}
+
+// get returns the transport of the dialer by its identity, like `DIRECT`
+// or the address of the upstream proxy. The returned function ends using
+// the transport, once the request is finished.
+func (p *transportPool) get(cfg *environment.Config, dialer proxy.Dialer) (*http.Transport, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cfg != p.cfg {
+		p.update(cfg)
+	}
+	key := dialer.String()
+	transport, ok := p.transports[key]
+	if !ok {
+		transport = &pooledTransport{Transport: newTransport(cfg, dialer)}
+		p.transports[key] = transport
+	}
+	transport.active++
+	var once sync.Once
+	return transport.Transport, func() {
+		once.Do(func() { p.done(transport) })
+	}
+}
+
+// update retires the transports which do not fit the new config.
+func (p *transportPool) update(cfg *environment.Config) {
+	settings := newTransportSettings(cfg)
+	used := map[string]bool{proxy.DialerName(nil): true}
+	for i := range cfg.Rules {
+		used[proxy.DialerName(&cfg.Rules[i])] = true
+	}
+	for key, transport := range p.transports {
+		if settings != p.settings || !used[key] {
+			delete(p.transports, key)
+			transport.retired = true
+			p.closeIfUnused(transport)
+		}
+	}
+	p.cfg, p.settings = cfg, settings
+}
+
+func (p *transportPool) done(transport *pooledTransport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	transport.active--
+	p.closeIfUnused(transport)
+}
+
+// closeIfUnused closes the connections of a retired transport without
+// requests. Closing the idle connections makes the transport close also
+// the connections becoming idle later, as no new requests reset it.
+func (p *transportPool) closeIfUnused(transport *pooledTransport) {
+	if transport.retired && transport.active == 0 {
+		transport.CloseIdleConnections()
+	}
+}
+
+// closeIdle closes the idle connections, the connections of the requests
+// in progress are closed when they become idle.
+func (p *transportPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+func newTransport(cfg *environment.Config, dialer proxy.Dialer) *http.Transport {
+	perHost := cfg.UpstreamMaxIdleConnectionsPerHost
+	if perHost <= 0 {
+		perHost = cfg.UpstreamMaxIdleConnections
+	}
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.Dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return metrics.CountingConn(conn, listenerName), nil
+		},
+		DisableKeepAlives:   cfg.UpstreamMaxIdleConnections <= 0,
+		MaxIdleConns:        cfg.UpstreamMaxIdleConnections,
+		MaxIdleConnsPerHost: perHost,
+		IdleConnTimeout:     cfg.UpstreamIdleTimeout(),
+	}
+}
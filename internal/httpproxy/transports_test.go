@@ -0,0 +1,132 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package httpproxy
+
+import (
+	"context"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDialer string
+
+func (d testDialer) String() string {
+	return string(d)
+}
+
+func (d testDialer) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func TestTransportPool(t *testing.T) {
+	p := newTransportPool()
+	cfg := &environment.Config{UpstreamMaxIdleConnections: 10}
+	direct, _ := p.get(cfg, testDialer("DIRECT"))
+	if same, _ := p.get(cfg, testDialer("DIRECT")); same != direct {
+		t.Fatalf("Transport of the same dialer should be reused")
+	}
+	if direct.DisableKeepAlives || direct.MaxIdleConnsPerHost != 10 {
+		t.Fatalf("Transport should keep idle connections by the config, got %+v", direct)
+	}
+	if other, _ := p.get(cfg, testDialer("PROXY http://proxy.test:3128")); other == direct {
+		t.Fatalf("Transport of another dialer should not be shared")
+	}
+	cfg = &environment.Config{UpstreamMaxIdleConnections: 10, Verbosity: environment.Debug}
+	if same, _ := p.get(cfg, testDialer("DIRECT")); same != direct {
+		t.Fatalf("Transport should be kept when its settings do not change")
+	}
+	if _, ok := p.transports["PROXY http://proxy.test:3128"]; ok {
+		t.Fatalf("Transport of a dialer no longer used should be retired")
+	}
+	cfg = &environment.Config{}
+	reloaded, _ := p.get(cfg, testDialer("DIRECT"))
+	if reloaded == direct {
+		t.Fatalf("Transport should be replaced when its settings change")
+	}
+	if !reloaded.DisableKeepAlives {
+		t.Fatalf("Transport should not keep idle connections without the limit")
+	}
+}
+
+// connStates counts the connection states of the server.
+type connStates struct {
+	mu     sync.Mutex
+	states map[http.ConnState]int
+	closed chan struct{}
+}
+
+func (c *connStates) record(_ net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states[state]++
+	if state == http.StateClosed {
+		c.closed <- struct{}{}
+	}
+}
+
+func (c *connStates) count(state http.ConnState) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.states[state]
+}
+
+func TestTransportPool_Reuse(t *testing.T) {
+	states := &connStates{states: map[http.ConnState]int{}, closed: make(chan struct{}, 10)}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(res, "ok")
+	}))
+	server.Config.ConnState = states.record
+	server.Start()
+	defer server.Close()
+	get := func(transport *http.Transport) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		return res
+	}
+
+	p := newTransportPool()
+	cfg := &environment.Config{UpstreamMaxIdleConnections: 10}
+	for i := 0; i < 2; i++ {
+		transport, done := p.get(cfg, testDialer("DIRECT"))
+		res := get(transport)
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		done()
+	}
+	if n := states.count(http.StateNew); n != 1 {
+		t.Fatalf("Second request should reuse the connection, got %d connections", n)
+	}
+
+	transport, done := p.get(cfg, testDialer("DIRECT"))
+	res := get(transport)
+	// the transport is retired while its request is in progress
+	p.get(&environment.Config{}, testDialer("DIRECT"))
+	if body, err := io.ReadAll(res.Body); err != nil || string(body) != "ok" {
+		t.Fatalf("Request of a retired transport should finish, got `%s`, %v", body, err)
+	}
+	_ = res.Body.Close()
+	if n := states.count(http.StateClosed); n != 0 {
+		t.Fatalf("Connection should be kept until the request is finished, got %d closed", n)
+	}
+	done()
+	select {
+	case <-states.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection of the retired transport should be closed")
+	}
+}
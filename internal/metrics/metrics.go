@@ -0,0 +1,228 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const namespace = "flexi_proxy"
+
+// Directions of transferred bytes.
+const (
+	// Upstream is from the client to the target
+	Upstream = "upstream"
+	// Downstream is from the target to the client
+	Downstream = "downstream"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+	factory  = promauto.With(registry)
+
+	activeConnections = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Number of open client connections.",
+	}, []string{"listener"})
+	connections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Number of accepted client connections.",
+	}, []string{"listener"})
+	rejectedConnections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_connections_total",
+		Help:      "Number of connections and HTTP requests rejected by limits, by the reason.",
+	}, []string{"listener", "reason"})
+	transferredBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Number of bytes relayed between clients and targets.",
+	}, []string{"listener", "direction"})
+	dialDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dial_duration_seconds",
+		Help:      "Duration of successful connecting to targets, by the dialer.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"dialer"})
+	dialErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_errors_total",
+		Help:      "Number of failures to connect to targets, by the dialer and the cause.",
+	}, []string{"dialer", "cause"})
+	ruleHits = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_hits_total",
+		Help:      "Number of requests resolved by the rule index, `none` when no rule matches.",
+	}, []string{"rule"})
+	lookupDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dns_lookup_duration_seconds",
+		Help:      "Duration of DNS lookups of target IP addresses.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"result"})
+	configReloads = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration loads by the result.",
+	}, []string{"result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// CountConnections counts the connections accepted by the listener,
+// a connection is active until it is closed.
+func CountConnections(l net.Listener, listener string) net.Listener {
+	return &countingListener{
+		Listener: l,
+		active:   activeConnections.WithLabelValues(listener),
+		total:    connections.WithLabelValues(listener),
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	active prometheus.Gauge
+	total  prometheus.Counter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.total.Inc()
+	l.active.Inc()
+	return &countedConn{Conn: conn, active: l.active}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	active prometheus.Gauge
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.active.Dec)
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection, if it is supported.
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ConnectionRejected records rejecting a connection or an HTTP request of
+// the listener by a limit.
+func ConnectionRejected(listener string, reason string) {
+	rejectedConnections.WithLabelValues(listener, reason).Inc()
+}
+
+// CountingReader counts the bytes read from the reader as transferred
+// in the direction.
+func CountingReader(r io.Reader, listener string, direction string) io.Reader {
+	return &countingReader{
+		reader:  r,
+		counter: transferredBytes.WithLabelValues(listener, direction),
+	}
+}
+
+type countingReader struct {
+	reader  io.Reader
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+// CountingConn counts the bytes written to the target connection as
+// transferred upstream and the bytes read from it as transferred downstream.
+func CountingConn(conn net.Conn, listener string) net.Conn {
+	return &countingConn{
+		Conn:       conn,
+		upstream:   transferredBytes.WithLabelValues(listener, Upstream),
+		downstream: transferredBytes.WithLabelValues(listener, Downstream),
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	upstream   prometheus.Counter
+	downstream prometheus.Counter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.downstream.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.upstream.Add(float64(n))
+	return n, err
+}
+
+// ObserveDial records connecting by the dialer, which started at the time.
+// The cause classifies the failure, it is empty when the dial succeeded.
+func ObserveDial(dialer string, start time.Time, cause string) {
+	if cause != "" {
+		dialErrors.WithLabelValues(dialer, cause).Inc()
+		return
+	}
+	dialDuration.WithLabelValues(dialer).Observe(time.Since(start).Seconds())
+}
+
+// RuleHit records resolving a request by the rule index, -1 for no rule.
+func RuleHit(rule int) {
+	label := "none"
+	if rule >= 0 {
+		label = strconv.Itoa(rule)
+	}
+	ruleHits.WithLabelValues(label).Inc()
+}
+
+// ObserveLookup records a DNS lookup, which started at the time.
+func ObserveLookup(start time.Time, err error) {
+	lookupDuration.WithLabelValues(result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ConfigReload records loading the configuration.
+func ConfigReload(err error) {
+	configReloads.WithLabelValues(result(err)).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	counted := CountConnections(l, "test")
+	defer func() { _ = counted.Close() }()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := counted.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	if active := testutil.ToFloat64(activeConnections.WithLabelValues("test")); active != 1 {
+		t.Fatalf("Accepted connection should be active, got %v", active)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+	if active := testutil.ToFloat64(activeConnections.WithLabelValues("test")); active != 0 {
+		t.Fatalf("Closed connection should not be active, got %v", active)
+	}
+	if total := testutil.ToFloat64(connections.WithLabelValues("test")); total != 1 {
+		t.Fatalf("Accepted connection should be counted once, got %v", total)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	r := CountingReader(strings.NewReader("hello world"), "test", Upstream)
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if n := testutil.ToFloat64(transferredBytes.WithLabelValues("test", Upstream)); n != 11 {
+		t.Fatalf("Read bytes should be counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(transferredBytes.WithLabelValues("test", Downstream)); n != 0 {
+		t.Fatalf("Other direction should not be counted, got %v", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	RuleHit(2)
+	RuleHit(-1)
+	ObserveDial("DIRECT", time.Now(), "")
+	ObserveDial("DIRECT", time.Now(), "refused")
+	ConfigReload(errors.New("invalid"))
+	res := httptest.NewRecorder()
+	Handler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`flexi_proxy_rule_hits_total{rule="2"} 1`,
+		`flexi_proxy_rule_hits_total{rule="none"} 1`,
+		`flexi_proxy_dial_duration_seconds_count{dialer="DIRECT"} 1`,
+		`flexi_proxy_dial_errors_total{cause="refused",dialer="DIRECT"} 1`,
+		`flexi_proxy_config_reloads_total{result="failure"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(res.Body.String(), line) {
+			t.Fatalf("Metrics should contain `%s`, got: %s", line, res.Body.String())
+		}
+	}
+}
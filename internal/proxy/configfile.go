@@ -0,0 +1,148 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configFile is the content of a single config file. The main config file
+// may include other files, e.g. `conf.d/*.toml`, which are merged into it:
+//   - files are merged in order, the main file first, then the included
+//     ones as listed, files matching a glob pattern ordered by name
+//   - settings defined in a later file override the earlier ones
+//   - rules of all files are concatenated in the order of the files, but
+//     rules of files with a higher Priority come first
+//
+// Relative paths in a file are relative to the directory of the file.
+type configFile struct {
+	Include  []string
+	Priority int
+	environment.Config
+}
+
+// loadedConfigFile is a decoded config file.
+type loadedConfigFile struct {
+	path string
+	data []byte
+	file configFile
+	meta toml.MetaData
+}
+
+// mergedKeys are the settings which are not copied between config files.
+var mergedKeys = map[string]bool{
+	"include":  true,
+	"priority": true,
+	"rules":    true,
+}
+
+// decodeConfigFile decodes the file in the format, or in the format by the
+// file extension when empty.
+func decodeConfigFile(path string, format string, file configFile) (*loadedConfigFile, error) {
+	format, err := configFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := decodeConfig(data, format, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &loadedConfigFile{
+		path: path,
+		data: data,
+		file: file,
+		meta: meta,
+	}, nil
+}
+
+// includedPaths expands the Include entries of the file. Entries without
+// glob characters need to exist.
+func (f *loadedConfigFile) includedPaths() ([]string, error) {
+	var paths []string
+	for _, include := range f.file.Include {
+		pattern := resolveRelative(filepath.Dir(f.path), include)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include `%s`: %w", f.path, include, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			return nil, fmt.Errorf("%s: include `%s`: file does not exist", f.path, include)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// resolvePaths makes the paths in the file relative to the directory of
+// the file.
+func (f *loadedConfigFile) resolvePaths() {
+	dir := filepath.Dir(f.path)
+	cfg := &f.file.Config
+	for _, path := range []*string{&cfg.GeoIPDatabase, &cfg.ASNDatabase, &cfg.AccessLog} {
+		// `-` is the stdout access log
+		if *path != "" && *path != "-" {
+			*path = resolveRelative(dir, *path)
+		}
+	}
+	for i := range cfg.Rules {
+		for j, path := range cfg.Rules[i].PatternFiles {
+			cfg.Rules[i].PatternFiles[j] = resolveRelative(dir, path)
+		}
+	}
+}
+
+func resolveRelative(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// mergeConfigFiles merges the files into the config of the first one. It
+// records the files the settings come from.
+func mergeConfigFiles(files []*loadedConfigFile, sources map[string]string) *environment.Config {
+	cfg := files[0].file.Config
+	target := reflect.ValueOf(&cfg).Elem()
+	for i, f := range files {
+		source := reflect.ValueOf(&f.file.Config).Elem()
+		for _, key := range f.meta.Keys() {
+			if len(key) != 1 || mergedKeys[strings.ToLower(key[0])] {
+				continue
+			}
+			match := func(name string) bool { return strings.EqualFold(name, key[0]) }
+			field, ok := target.Type().FieldByNameFunc(match)
+			if !ok || !field.IsExported() {
+				continue
+			}
+			if i > 0 {
+				target.FieldByIndex(field.Index).Set(source.FieldByIndex(field.Index))
+			}
+			sources[field.Name] = "file " + f.path
+		}
+	}
+	ordered := append([]*loadedConfigFile(nil), files...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].file.Priority > ordered[j].file.Priority
+	})
+	cfg.Rules = nil
+	for _, f := range ordered {
+		cfg.Rules = append(cfg.Rules, f.file.Rules...)
+	}
+	if cfg.Rules == nil && files[0].file.Rules != nil {
+		cfg.Rules = []environment.Rule{}
+	}
+	return &cfg
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfig_Include(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+Include = ["conf.d/*.toml"]
+HttpListenAddr = "127.0.0.1:9001"
+[[Rules]]
+Proxy = "http://team.test:3128"
+Patterns = [".corp"]
+`,
+		"conf.d/20-personal.toml": `
+Priority = 10
+HttpListenAddr = "127.0.0.1:9101"
+[[Rules]]
+Proxy = "http://personal.test:3128"
+PatternFiles = ["personal.txt"]
+`,
+		"conf.d/10-extra.toml": `
+ConnectTimeoutMillis = 5000
+[[Rules]]
+Patterns = ["."]
+`,
+		"conf.d/personal.txt": "a.corp\n",
+		"conf.d/ignored.txt":  "Include = 1",
+	})
+	env, err := LoadEnvironment(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg := env.Config()
+	if cfg.HttpListenAddr != "127.0.0.1:9101" || cfg.SocksListenAddr != "127.0.0.1:8002" || cfg.ConnectTimeoutMillis != 5000 {
+		t.Fatalf("Settings of included files should override the earlier ones, got %+v", cfg)
+	}
+	proxies := []string{"personal.test:3128", "team.test:3128", ""}
+	if len(cfg.Rules) != len(proxies) {
+		t.Fatalf("Expected %d rules, got %+v", len(proxies), cfg.Rules)
+	}
+	for i, proxy := range proxies {
+		if addr := cfg.Rules[i].ProxyAddr(); addr != proxy {
+			t.Fatalf("Rule[%d] should use proxy `%s`, got `%s`", i, proxy, addr)
+		}
+	}
+	if patterns := cfg.Rules[0].ListPatterns(); len(patterns) != 1 || patterns[0] != "a.corp" {
+		t.Fatalf("Pattern files should be relative to the included file, got %v", patterns)
+	}
+}
+
+func TestLoadConfig_InvalidInclude(t *testing.T) {
+	tests := []map[string]string{
+		{"proxy.toml": `Include = ["missing.toml"]`},
+		{"proxy.toml": `Include = ["a.toml"]`, "a.toml": `Include = ["b.toml"]`, "b.toml": ``},
+	}
+	for _, files := range tests {
+		dir := writeTestFiles(t, files)
+		if _, err := LoadEnvironment(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, environment.NewLogger(io.Discard, "")); err == nil || !strings.Contains(err.Error(), "include") {
+			t.Fatalf("Include in %v should be rejected, got %v", files, err)
+		}
+	}
+}
+
+func TestEnvLoader_ReloadOnIncludedFile(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+Include = ["conf.d/*.toml"]
+[[Rules]]
+Proxy = "http://a.test:3128"
+Patterns = ["."]
+`,
+	})
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	l, _ := startTestWatcher(t, filepath.Join(dir, "proxy.toml"), true)
+	waitForProxyAddr(t, l, "a.test:3128")
+	content := "Priority = 1\n" + strings.Replace(proxyConfig, "%s", "b.test", 1)
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "b.toml"), []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitForProxyAddr(t, l, "b.test:3128")
+	content = "Priority = 1\n" + strings.Replace(proxyConfig, "%s", "c.test", 1)
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "b.toml"), []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitForProxyAddr(t, l, "c.test:3128")
+}
+
+func TestEnvLoader_StatusOfIncludedFiles(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+Include = ["conf.d/*.toml"]
+[[Rules]]
+Proxy = "http://a.test:3128"
+Patterns = ["."]
+`,
+		"conf.d/a.toml": "Verbosity = 1\n",
+	})
+	l, err := newEnvLoader(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, time.Hour, environment.NewLogger(io.Discard, ""), false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	defer l.Stop()
+	if status := l.Status(); status.Modified {
+		t.Fatalf("Status should not be modified after loading, got %+v", status)
+	}
+	added := filepath.Join(dir, "conf.d", "b.toml")
+	if err := os.WriteFile(added, []byte("Verbosity = 2\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if status := l.Status(); !status.Modified {
+		t.Fatalf("Added included file should be a modification, got %+v", status)
+	}
+	_ = os.Remove(added)
+	if status := l.Status(); status.Modified {
+		t.Fatalf("Status should not be modified after removing the added file, got %+v", status)
+	}
+	_ = os.Remove(filepath.Join(dir, "conf.d", "a.toml"))
+	if status := l.Status(); !status.Modified {
+		t.Fatalf("Removed included file should be a modification, got %+v", status)
+	}
+}
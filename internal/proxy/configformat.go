@@ -0,0 +1,143 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Config file formats. JSON and YAML files are translated to TOML, so all
+// formats are decoded the same way, with the same unknown field checks and
+// case-insensitive keys.
+const (
+	FormatToml = "toml"
+	FormatJson = "json"
+	FormatYaml = "yaml"
+)
+
+var formatExtensions = map[string]string{
+	".toml": FormatToml,
+	".json": FormatJson,
+	".yaml": FormatYaml,
+	".yml":  FormatYaml,
+}
+
+// configFormat returns the given format, or the format by the extension of
+// the file, TOML by default.
+func configFormat(path string, format string) (string, error) {
+	if format == "" {
+		if f, ok := formatExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+			return f, nil
+		}
+		return FormatToml, nil
+	}
+	switch format = strings.ToLower(format); format {
+	case FormatToml, FormatJson, FormatYaml:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported config format `%s`", format)
+	}
+}
+
+func decodeConfig(data []byte, format string, v interface{}) (toml.MetaData, error) {
+	var content map[string]interface{}
+	switch format {
+	case FormatToml:
+		return toml.Decode(string(data), v)
+	case FormatJson:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&content); err != nil {
+			return toml.MetaData{}, err
+		}
+	case FormatYaml:
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			return toml.MetaData{}, err
+		}
+	default:
+		return toml.MetaData{}, fmt.Errorf("unsupported config format `%s`", format)
+	}
+	var translated bytes.Buffer
+	if err := toml.NewEncoder(&translated).Encode(tomlValue(content)); err != nil {
+		return toml.MetaData{}, err
+	}
+	return toml.Decode(translated.String(), v)
+}
+
+// tomlValue converts decoded JSON or YAML to values supported by TOML.
+// Null values are dropped.
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if item != nil {
+				m[key] = tomlValue(item)
+			}
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				items = append(items, tomlValue(item))
+			}
+		}
+		return items
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil && !math.IsInf(f, 0) {
+			return f
+		}
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// EncodeConfig writes the config in the format. The keys are named after
+// the fields of the config in all formats.
+func EncodeConfig(w io.Writer, cfg *environment.Config, format string) error {
+	format = strings.ToLower(format)
+	var encoded bytes.Buffer
+	if err := toml.NewEncoder(&encoded).Encode(cfg); err != nil {
+		return err
+	}
+	if format == FormatToml {
+		_, err := w.Write(encoded.Bytes())
+		return err
+	}
+	var content map[string]interface{}
+	if _, err := toml.Decode(encoded.String(), &content); err != nil {
+		return err
+	}
+	switch format {
+	case FormatJson:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(content)
+	case FormatYaml:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(content); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return fmt.Errorf("unsupported config format `%s`", format)
+	}
+}
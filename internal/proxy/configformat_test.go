@@ -0,0 +1,177 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFormat(t *testing.T) {
+	tests := []struct {
+		path     string
+		format   string
+		expected string
+	}{
+		{"proxy.toml", "", FormatToml},
+		{"proxy.JSON", "", FormatJson},
+		{"proxy.yml", "", FormatYaml},
+		{"proxy.yaml", "", FormatYaml},
+		{"proxy.conf", "", FormatToml},
+		{"proxy.conf", "YAML", FormatYaml},
+		{"proxy.toml", "json", FormatJson},
+	}
+	for _, tt := range tests {
+		if format, err := configFormat(tt.path, tt.format); err != nil || format != tt.expected {
+			t.Fatalf("Format of `%s` with `%s` should be `%s`, got `%s` %v", tt.path, tt.format, tt.expected, format, err)
+		}
+	}
+	if _, err := configFormat("proxy.toml", "ini"); err == nil {
+		t.Fatalf("Format `ini` should be rejected")
+	}
+}
+
+func TestLoadConfig_Formats(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+HttpListenAddr = "127.0.0.1:9001"
+ConnectTimeoutMillis = 5000
+Unknown = 1
+[[Rules]]
+Proxy = "http://proxy.test:3128"
+Patterns = [".corp", "10.0.0.0/8"]
+Ports = ["443"]
+[[Rules]]
+Patterns = ["."]
+`,
+		"proxy.json": `{
+  "httpListenAddr": "127.0.0.1:9001",
+  "connectTimeoutMillis": 5000,
+  "unknown": null,
+  "Unknown": 1,
+  "rules": [
+    {"proxy": "http://proxy.test:3128", "patterns": [".corp", "10.0.0.0/8"], "ports": ["443"]},
+    {"patterns": ["."]}
+  ]
+}`,
+		"proxy.yaml": `
+httpListenAddr: 127.0.0.1:9001
+connectTimeoutMillis: 5000
+Unknown: 1
+rules:
+  - proxy: http://proxy.test:3128
+    patterns: [.corp, 10.0.0.0/8]
+    ports: ["443"]
+  - patterns: [.]
+`,
+	})
+	var expected interface{}
+	for _, name := range []string{"proxy.toml", "proxy.json", "proxy.yaml"} {
+		path := filepath.Join(dir, name)
+		if _, err := CheckConfig(ConfigSource{Path: path}, environment.NewLogger(io.Discard, "")); err == nil {
+			t.Fatalf("Unknown field in `%s` should be reported", name)
+		}
+		env, err := LoadEnvironment(ConfigSource{Path: path}, environment.NewLogger(io.Discard, ""))
+		if err != nil {
+			t.Fatalf("Failed to load `%s`: %v", name, err)
+		}
+		var encoded bytes.Buffer
+		if err := EncodeConfig(&encoded, env.Config(), FormatJson); err != nil {
+			t.Fatalf("Failed to encode config: %v", err)
+		}
+		if expected == nil {
+			expected = encoded.String()
+		} else if encoded.String() != expected {
+			t.Fatalf("Config `%s` should be the same as TOML one, got %s", name, encoded.String())
+		}
+	}
+}
+
+func TestEncodeConfig_RoundTrip(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+SocksListenAddr = ""
+Verbosity = 2
+[[Rules]]
+Proxy = "http://proxy.test:3128"
+Patterns = [".corp", "!a.corp"]
+Schedule = ["Mon-Fri 09:00-17:00"]
+TimeZone = "UTC"
+`,
+	})
+	env, err := LoadEnvironment(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	for _, format := range []string{FormatToml, FormatJson, FormatYaml} {
+		var encoded bytes.Buffer
+		if err := EncodeConfig(&encoded, env.Config(), format); err != nil {
+			t.Fatalf("Failed to encode config as %s: %v", format, err)
+		}
+		path := writeTestFiles(t, map[string]string{"proxy." + format: encoded.String()})
+		converted, err := LoadEnvironment(ConfigSource{Path: filepath.Join(path, "proxy."+format)}, environment.NewLogger(io.Discard, ""))
+		if err != nil {
+			t.Fatalf("Failed to load config converted to %s: %v\n%s", format, err, encoded.String())
+		}
+		if !reflect.DeepEqual(converted.Config().Rules[0].Schedule, env.Config().Rules[0].Schedule) || converted.Config().Verbosity != 2 || converted.Config().SocksListenAddr != "" {
+			t.Fatalf("Config converted to %s should be the same, got %+v", format, converted.Config())
+		}
+	}
+}
+
+func TestLoadMergedConfig_RoundTrip(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+SystemProxyRules = true
+[[Rules]]
+Proxy = "http://corp.test:3128"
+Patterns = [".corp"]
+`,
+	})
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("HTTP_PROXY", "proxy.test:3128")
+	t.Setenv("NO_PROXY", "localhost")
+	t.Setenv("FLEXI_CONNECT_TIMEOUT_MILLIS", "2000")
+	source := ConfigSource{Path: filepath.Join(dir, "proxy.toml"), Flags: map[string]string{"Verbosity": "debug"}}
+	cfg, err := LoadMergedConfig(source, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	env, err := LoadEnvironment(source, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	var encoded bytes.Buffer
+	if err := EncodeConfig(&encoded, cfg, FormatToml); err != nil {
+		t.Fatalf("Failed to encode config: %v", err)
+	}
+	path := filepath.Join(writeTestFiles(t, map[string]string{"converted.toml": encoded.String()}), "converted.toml")
+	_ = os.Unsetenv("FLEXI_CONNECT_TIMEOUT_MILLIS")
+	converted, err := LoadMergedConfig(ConfigSource{Path: path}, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load converted config: %v\n%s", err, encoded.String())
+	}
+	var reencoded bytes.Buffer
+	if err := EncodeConfig(&reencoded, converted, FormatToml); err != nil {
+		t.Fatalf("Failed to encode config: %v", err)
+	}
+	if reencoded.String() != encoded.String() {
+		t.Fatalf("Converted config should load the same, got\n%s\nexpected\n%s", reencoded.String(), encoded.String())
+	}
+	convertedEnv, err := LoadEnvironment(ConfigSource{Path: path}, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to load converted config: %v", err)
+	}
+	if n := len(convertedEnv.Config().Rules); n != len(env.Config().Rules) || !cfg.SystemProxyRules || cfg.ConnectTimeoutMillis != 2000 || cfg.Verbosity != environment.Debug {
+		t.Fatalf("Converted config should have the overrides and the same rules, got %d rules instead of %d\n%s", n, len(env.Config().Rules), encoded.String())
+	}
+}
@@ -6,10 +6,15 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
+	"golang.org/x/exp/slog"
 	"net"
-	"strings"
+	"net/netip"
+	"syscall"
+	"time"
 )
 
 type Dialer interface {
@@ -17,10 +22,109 @@ type Dialer interface {
 	Dial(ctx context.Context, network, address string) (net.Conn, error)
 }
 
-func ResolveDialer(env *environment.Environment, fqdn string, ip net.IP) Dialer {
-	env.Debug("resolve: %v / %v", fqdn, ip)
-	normalizedDomainName := strings.ToLower(fqdn)
-	rule := env.ResolveProxyRule(normalizedDomainName, ip)
+// Route is the way to a target by the matching rule.
+type Route struct {
+	Dialer Dialer
+	// Target of the route, normalized
+	Target Target
+	// Rule is the index of the matching rule in Config, -1 when no rule
+	// matches
+	Rule int
+	// RuleKey identifies the matching rule across configs, see Rule.Key
+	RuleKey string
+	// Config is the config the route was resolved by
+	Config *environment.Config
+	// IP of the target, it is looked up only when some rule needs it
+	IP *environment.LazyIP
+	// IdleTimeout and MaxLifetime limit tunnels, zero for no limit
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// Bandwidth of the rule, shared by its connections
+	Bandwidth environment.Bandwidth
+}
+
+// ResolveRoute finds the route to the target by the configured rules.
+// The client is the remote address of the proxy client connection. The rule
+// hits are counted by the proxies, not to count resolving by the admin API.
+func ResolveRoute(env *environment.Environment, target Target, client string) *Route {
+	env.Debug("Resolving", "target", target.String(), "client", client)
+	req := newRequest(env, target, client)
+	i, rule, cfg := env.MatchProxyRule(req)
+	route := &Route{
+		Dialer: &measuredDialer{dialerForRule(env, rule, target)},
+		Target: target,
+		Rule:   i,
+		IP:     req.IP,
+		Config: cfg,
+	}
+	route.IdleTimeout, route.MaxLifetime = cfg.TunnelLimits(rule)
+	if rule != nil {
+		route.RuleKey = rule.Key()
+		route.Bandwidth = rule.Bandwidth()
+	}
+	return route
+}
+
+// LogAttrs describes the route in log records, the IP only when it was
+// looked up.
+func (r *Route) LogAttrs() []any {
+	attrs := []any{"rule", r.Rule, "dialer", r.Dialer.String()}
+	if ip := r.IP.Peek(); ip != nil {
+		attrs = append([]any{"ip", ip}, attrs...)
+	}
+	return attrs
+}
+
+// ResolveDialer finds the dialer for the target, like ResolveRoute.
+func ResolveDialer(env *environment.Environment, target Target, client string) Dialer {
+	return ResolveRoute(env, target, client).Dialer
+}
+
+// TransferAttrs describes a finished transfer in log records.
+func TransferAttrs(start time.Time, upstream, downstream int64) []any {
+	return []any{"duration", time.Since(start), slog.Group("bytes", "up", upstream, "down", downstream)}
+}
+
+// TunnelCloseReason describes why a tunnel was closed: by the reason of
+// closing it by the proxy, by the relay error, or by the side which closed
+// the connection first, the client when the upstream direction ended first.
+func TunnelCloseReason(closed error, err error, first string) string {
+	switch {
+	case closed != nil:
+		return closed.Error()
+	case err != nil:
+		return "relay error"
+	case first == metrics.Upstream:
+		return "client closed"
+	default:
+		return "target closed"
+	}
+}
+
+func newRequest(env *environment.Environment, target Target, client string) *environment.Request {
+	req := &environment.Request{
+		DomainName: target.Host,
+		Port:       target.Port,
+		Client:     clientIP(client),
+	}
+	if target.IP.IsValid() {
+		req.IP = environment.StaticIP(target.IP.AsSlice())
+	} else {
+		req.IP = LookupIP(env, target.Host)
+	}
+	return req
+}
+
+// DialerName is the identity of the dialer of the rule, the same as
+// the String of the dialer. No rule means the direct dialer.
+func DialerName(rule *environment.Rule) string {
+	if rule.ProxyScheme() == "" {
+		return "DIRECT"
+	}
+	return "PROXY " + rule.ProxyScheme() + "://" + rule.ProxyAddr()
+}
+
+func dialerForRule(env *environment.Environment, rule *environment.Rule, target Target) Dialer {
 	switch rule.ProxyScheme() {
 	case "":
 		return &dialerDirect{
@@ -32,13 +136,50 @@ func ResolveDialer(env *environment.Environment, fqdn string, ip net.IP) Dialer
 			env:       env,
 			dial:      mkDialerFunc(env),
 			proxyAddr: rule.ProxyAddr(),
-			fqdn:      normalizedDomainName,
+			fqdn:      target.Host,
 		}
 	default:
 		panic("unknown rule proxy schema: " + rule.ProxyScheme())
 	}
 }
 
+// measuredDialer records the dial latency and failures of the dialer.
+type measuredDialer struct {
+	Dialer
+}
+
+func (d *measuredDialer) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.Dialer.Dial(ctx, network, address)
+	metrics.ObserveDial(d.String(), start, dialErrorCause(err))
+	return conn, err
+}
+
+// dialErrorCause classifies the dial failure, it is empty for no error.
+func dialErrorCause(err error) string {
+	var dnsErr *net.DNSError
+	var statusErr proxyStatusError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &statusErr):
+		return "proxy_status"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
 type dialerFunc func(ctx context.Context, network, address string) (conn net.Conn, err error)
 
 func mkDialerFunc(env *environment.Environment) dialerFunc {
@@ -53,7 +194,7 @@ func mkDialerFunc(env *environment.Environment) dialerFunc {
 				_ = conn.Close()
 			}
 		}()
-		env.Debug("dial: connecting: %s://%s", network, address)
+		env.Debug("Connecting", "network", network, "address", address)
 
 		ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout())
 		defer cancel()
@@ -63,7 +204,18 @@ func mkDialerFunc(env *environment.Environment) dialerFunc {
 			return nil, err
 		}
 
-		env.Debug("dial: connected: %s://%s", network, address)
+		env.Debug("Connected", "network", network, "address", address)
 		return conn, nil
 	}
 }
+
+func clientIP(client string) net.IP {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().AsSlice()
+	}
+	return nil
+}
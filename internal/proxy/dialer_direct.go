@@ -26,7 +26,7 @@ func (d *dialerDirect) Dial(ctx context.Context, network, address string) (conn
 			_ = conn.Close()
 		}
 	}()
-	d.env.Debug("dial connecting: %s => %s://%s", d, network, address)
+	d.env.Debug("Dialing", "dialer", d.String(), "network", network, "address", address)
 
 	ctx, cancel := context.WithTimeout(ctx, d.env.Config().ConnectTimeout())
 	defer cancel()
@@ -36,7 +36,7 @@ func (d *dialerDirect) Dial(ctx context.Context, network, address string) (conn
 		return nil, d.mkError(err, "unable to connect")
 	}
 
-	d.env.Debug("dial: connected: %s => %s://%s", d, network, address)
+	d.env.Debug("Dialed", "dialer", d.String(), "network", network, "address", address)
 	return conn, nil
 }
 
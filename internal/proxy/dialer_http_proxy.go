@@ -48,7 +48,7 @@ func (d *dialerHttpProxy) Dial(ctx context.Context, network, address string) (co
 		return nil, d.mkError(err, "unable to read response")
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, d.mkError(fmt.Errorf("%s", resp.Status), "got response status")
+		return nil, d.mkError(proxyStatusError(resp.Status), "got response status")
 	}
 
 	return conn, nil
@@ -59,3 +59,10 @@ func (d *dialerHttpProxy) mkError(cause error, format string, args ...interface{
 		d, fmt.Sprintf(format, args...), cause,
 	)
 }
+
+// proxyStatusError is the unexpected response status of the upstream proxy.
+type proxyStatusError string
+
+func (e proxyStatusError) Error() string {
+	return string(e)
+}
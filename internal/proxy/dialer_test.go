@@ -0,0 +1,110 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialErrorCause(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	if err := env.SetConfig(&environment.Config{ConnectTimeoutMillis: 1000, Rules: []environment.Rule{
+		{Proxy: "http://proxy.test:3128", Patterns: []string{".proxy"}},
+		{Patterns: []string{"."}},
+	}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = upstream.Close() }()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+			_ = conn.Close()
+		}
+	}()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	direct := &dialerDirect{env: env, dial: mkDialerFunc(env)}
+	proxied := &dialerHttpProxy{env: env, dial: mkDialerFunc(env), proxyAddr: upstream.Addr().String()}
+	tests := []struct {
+		dialer Dialer
+		ctx    context.Context
+		addr   string
+		cause  string
+	}{
+		{direct, context.Background(), upstream.Addr().String(), ""},
+		{direct, context.Background(), closedAddr, "refused"},
+		{direct, canceled, upstream.Addr().String(), "canceled"},
+		{direct, context.Background(), "invalid.invalid:80", "dns"},
+		{proxied, context.Background(), "target.test:443", "proxy_status"},
+	}
+	for _, tt := range tests {
+		conn, err := tt.dialer.Dial(tt.ctx, "tcp", tt.addr)
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if cause := dialErrorCause(err); cause != tt.cause {
+			t.Fatalf("Dialing `%s` by %s should fail by `%s`, got `%s` %v", tt.addr, tt.dialer, tt.cause, cause, err)
+		}
+	}
+	if cause := dialErrorCause(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)); cause != "timeout" {
+		t.Fatalf("Deadline should be a timeout, got `%s`", cause)
+	}
+}
+
+func TestResolveRoute_TunnelLimits(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	millis := func(ms int) *int { return &ms }
+	if err := env.SetConfig(&environment.Config{TunnelIdleTimeoutMillis: 60_000, TunnelMaxLifetimeMillis: 3_600_000, Rules: []environment.Rule{
+		{Patterns: []string{".stream"}, IdleTimeoutMillis: millis(600_000)},
+		{Patterns: []string{".ssh"}, IdleTimeoutMillis: millis(0), MaxLifetimeMillis: millis(0)},
+		{Patterns: []string{"."}},
+	}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	tests := []struct {
+		target   string
+		idle     time.Duration
+		lifetime time.Duration
+	}{
+		{"video.stream:443", 10 * time.Minute, time.Hour},
+		{"jump.ssh:22", 0, 0},
+		{"example.com:443", time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		target, err := ParseTarget(tt.target, "")
+		if err != nil {
+			t.Fatalf("Failed to parse target: %v", err)
+		}
+		route := ResolveRoute(env, target, "")
+		if route.IdleTimeout != tt.idle || route.MaxLifetime != tt.lifetime {
+			t.Fatalf("Target `%s` should have limits %v and %v, got %v and %v", tt.target, tt.idle, tt.lifetime, route.IdleTimeout, route.MaxLifetime)
+		}
+	}
+	err := env.SetConfig(&environment.Config{Rules: []environment.Rule{{Patterns: []string{"."}, IdleTimeoutMillis: millis(-1)}}})
+	if err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("Negative tunnel limits should be rejected, got %v", err)
+	}
+}
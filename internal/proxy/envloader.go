@@ -7,92 +7,482 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"github.com/psvo/flexi-proxy/internal/environment"
-	"log"
+	"github.com/psvo/flexi-proxy/internal/metrics"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// reloadDebounce is the delay of reloading after a file event, so that
+// following events cause a single reload.
+const reloadDebounce = 200 * time.Millisecond
+
 type EnvLoader struct {
 	configFilePath string
-	pollPeriod     time.Duration
-	env            *environment.Environment
-	ctx            context.Context
-	cancel         context.CancelFunc
-	lastStat       os.FileInfo
+	// format of the config file, by its extension when empty
+	format string
+	// settings from command line flags
+	flags      map[string]string
+	pollPeriod time.Duration
+	env        *environment.Environment
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// last known state of the config file and pattern files,
+	// nil for files which could not be read
+	watched     map[string]os.FileInfo
+	remoteLists *remoteLists
+	// strict rejects configs with unknown fields
+	strict bool
+	// mu guards loading and the history of applied configs
+	mu      sync.Mutex
+	history *configHistory
+	// merged is the applied config as merged from the config files and
+	// the overrides, without the system proxy rules and the pattern lists
+	merged *environment.Config
+	// reload requests handled by the watcher, which replies with the result
+	reloads chan chan error
 }
 
-func NewEnvironmentLoader(configFilePath string, pollPeriod time.Duration, logger *log.Logger) (*EnvLoader, error) {
-	env := environment.NewEnvironment(logger)
-	stat, err := os.Stat(configFilePath)
+func NewEnvironmentLoader(source ConfigSource, pollPeriod time.Duration, logger *environment.Logger) (*EnvLoader, error) {
+	envLoader, err := newEnvLoader(source, pollPeriod, logger, false)
 	if err != nil {
 		return nil, err
 	}
-	if err := loadConfig(env, configFilePath); err != nil {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		envLoader.runWatcher(newFileWatcher(envLoader.env), hup)
+	}()
+	return envLoader, nil
+}
+
+// LoadEnvironment loads the configuration once, without watching for changes.
+func LoadEnvironment(source ConfigSource, logger *environment.Logger) (*environment.Environment, error) {
+	envLoader, err := newEnvLoader(source, 0, logger, false)
+	if err != nil {
+		return nil, err
+	}
+	envLoader.Stop()
+	return envLoader.Env(), nil
+}
+
+// CheckConfig loads the configuration once, like LoadEnvironment, but it
+// also rejects unknown fields. It returns the problems which do not prevent
+// using the configuration, like shadowed and duplicate patterns.
+func CheckConfig(source ConfigSource, logger *environment.Logger) ([]string, error) {
+	envLoader, err := newEnvLoader(source, 0, logger, true)
+	if err != nil {
+		return nil, err
+	}
+	envLoader.Stop()
+	return envLoader.Env().Config().Lint(), nil
+}
+
+// LoadMergedConfig loads the configuration once, like LoadEnvironment, and
+// returns it as merged from the config files, FLEXI_* variables and flags,
+// before the system proxy rules and the pattern lists are added. Encoded,
+// it loads as the same configuration.
+func LoadMergedConfig(source ConfigSource, logger *environment.Logger) (*environment.Config, error) {
+	envLoader, err := newEnvLoader(source, 0, logger, false)
+	if err != nil {
+		return nil, err
+	}
+	envLoader.Stop()
+	return envLoader.merged, nil
+}
+
+func newEnvLoader(source ConfigSource, pollPeriod time.Duration, logger *environment.Logger, strict bool) (*EnvLoader, error) {
+	env := environment.NewEnvironment(logger)
+	if _, err := os.Stat(source.Path); err != nil {
 		return nil, err
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	envLoader := &EnvLoader{
-		configFilePath: configFilePath,
+		configFilePath: source.Path,
+		format:         source.Format,
+		flags:          source.Flags,
 		pollPeriod:     pollPeriod,
 		env:            env,
 		ctx:            ctx,
 		cancel:         cancel,
-		lastStat:       stat,
+		remoteLists:    newRemoteLists(ctx),
+		strict:         strict,
+		history:        newConfigHistory(),
+		reloads:        make(chan chan error),
+	}
+	if err := envLoader.reload(); err != nil {
+		cancel()
+		return nil, err
 	}
-	go envLoader.runWatcher()
 	return envLoader, nil
 }
 
-func loadConfig(env *environment.Environment, configFilePath string) error {
-	cfg := &environment.Config{
-		ConnectTimeoutMillis: 10_000,
-		HttpListenAddr:       "127.0.0.1:8001",
-		SocksListenAddr:      "127.0.0.1:8002",
+// reload loads the config, recording a failure in the history and metrics.
+func (l *EnvLoader) reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.loadConfig()
+	if err != nil {
+		l.history.failed(err)
 	}
-	meta, err := toml.DecodeFile(configFilePath, cfg)
+	metrics.ConfigReload(err)
+	return err
+}
+
+func (l *EnvLoader) loadConfig() error {
+	env := l.env
+	l.watched = map[string]os.FileInfo{}
+	files, err := l.loadConfigFiles()
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %s: %w", configFilePath, err)
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	sources := map[string]string{}
+	cfg := mergeConfigFiles(files, sources)
+	if err := applyOverrides(cfg, l.flags, sources); err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	merged := cfg.Clone()
+	if cfg.SystemProxyRules {
+		cfg.Rules = append(cfg.Rules, systemProxyRules(env, cfg, os.Getenv)...)
 	}
-	if uKeys := meta.Undecoded(); len(uKeys) > 0 {
-		env.Warn("Config file has unknown fields: %v", uKeys)
+	for _, path := range []string{cfg.GeoIPDatabase, cfg.ASNDatabase} {
+		if path != "" {
+			l.watch(path)
+		}
+	}
+	if err := l.loadPatternLists(cfg); err != nil {
+		return fmt.Errorf("failed to load configuration: %s: %w", l.configFilePath, err)
+	}
+	env.Debug("Loaded configuration", "config", cfg)
+	hash, err := effectiveConfigHash(cfg)
+	if err != nil {
+		return fmt.Errorf("cannot encode the loaded configuration: %w", err)
 	}
-	env.Debug("Loaded configuration: %+v", cfg)
 	err = env.SetConfig(cfg)
 	if err != nil {
 		return fmt.Errorf("cannot use the loaded configuration: %w", err)
 	}
+	l.merged = merged
+	var contents [][]byte
+	for _, f := range files {
+		contents = append(contents, f.data)
+	}
+	revision := l.history.applied(hash, configHash(contents), cfg)
+	env.Info("Applied configuration", "hash", revision.Hash[:12], "files", len(files))
+	logSettings(env, cfg, sources)
 	return nil
 }
 
+// loadConfigFiles decodes the main config file and the files it includes.
+func (l *EnvLoader) loadConfigFiles() ([]*loadedConfigFile, error) {
+	env := l.env
+	l.watch(l.configFilePath)
+	main, err := decodeConfigFile(l.configFilePath, l.format, configFile{
+		Config: environment.Config{
+			ConnectTimeoutMillis:              10_000,
+			PatternCacheDir:                   defaultPatternCacheDir(),
+			PatternRefreshMillis:              3_600_000,
+			QueueTimeoutMillis:                5_000,
+			QueueMaxConnections:               1_000,
+			ShutdownDrainMillis:               10_000,
+			UpstreamIdleTimeoutMillis:         90_000,
+			UpstreamMaxIdleConnections:        100,
+			UpstreamMaxIdleConnectionsPerHost: 10,
+			HttpListenAddr:                    "127.0.0.1:8001",
+			SocksListenAddr:                   "127.0.0.1:8002",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, include := range main.file.Include {
+		// the directory changes when included files are added or removed
+		l.watch(filepath.Dir(resolveRelative(filepath.Dir(l.configFilePath), include)))
+	}
+	paths, err := main.includedPaths()
+	if err != nil {
+		return nil, err
+	}
+	files := []*loadedConfigFile{main}
+	for _, path := range paths {
+		l.watch(path)
+		f, err := decodeConfigFile(path, "", configFile{})
+		if err != nil {
+			return nil, err
+		}
+		if len(f.file.Include) > 0 {
+			return nil, fmt.Errorf("%s: included files cannot include other files", path)
+		}
+		files = append(files, f)
+	}
+	for _, f := range files {
+		if uKeys := f.meta.Undecoded(); len(uKeys) > 0 && l.strict {
+			return nil, fmt.Errorf("%s: unknown fields: %v", f.path, uKeys)
+		} else if len(uKeys) > 0 {
+			env.Warn("Config file has unknown fields", "path", f.path, "fields", fmt.Sprint(uKeys))
+		}
+		f.resolvePaths()
+	}
+	return files, nil
+}
+
+// loadPatternLists adds the list patterns of the rules from pattern files
+// and URLs.
+func (l *EnvLoader) loadPatternLists(cfg *environment.Config) error {
+	env := l.env
+	l.remoteLists.setCacheDir(cfg.PatternCacheDir)
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		for _, path := range rule.PatternFiles {
+			l.watch(path)
+			patterns, skipped, err := readPatternFile(path)
+			if err != nil {
+				return fmt.Errorf("rule[%d] %w", i, err)
+			}
+			if skipped > 0 {
+				env.Warn("Skipped unsupported lines of pattern list", "rule", i, "lines", skipped, "path", path)
+			}
+			rule.AddListPatterns(patterns)
+		}
+		for _, listUrl := range rule.PatternURLs {
+			patterns, skipped := l.remoteLists.get(env, listUrl)
+			if skipped > 0 {
+				env.Warn("Skipped unsupported lines of pattern list", "rule", i, "lines", skipped, "url", listUrl)
+			}
+			rule.AddListPatterns(patterns)
+		}
+	}
+	return nil
+}
+
+func readPatternFile(path string) ([]string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = f.Close() }()
+	patterns, skipped, err := parsePatternList(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return patterns, skipped, nil
+}
+
+// watch records the current state of the file, so its changes can be
+// detected. It needs to be called before the file is read.
+func (l *EnvLoader) watch(path string) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		stat = nil
+	}
+	l.watched[path] = stat
+}
+
 func (l *EnvLoader) Env() *environment.Environment {
 	return l.env
 }
 
+// Status describes the applied configurations and the last reload failure.
+func (l *EnvLoader) Status() ReloadStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := l.history.status()
+	hash, err := l.filesHash()
+	if err != nil {
+		return status
+	}
+	status.FileHash = hash
+	status.Modified = status.Current != nil && status.FileHash != status.Current.filesHash
+	return status
+}
+
+// filesHash hashes the config files as they are now. The includes are
+// expanded again, so added and removed files count as changes.
+func (l *EnvLoader) filesHash() (string, error) {
+	main, err := decodeConfigFile(l.configFilePath, l.format, configFile{})
+	if err != nil {
+		// the includes of an invalid file are unknown, but it differs
+		// from the applied one anyway
+		data, err := os.ReadFile(l.configFilePath)
+		if err != nil {
+			return "", err
+		}
+		return configHash([][]byte{data}), nil
+	}
+	paths, err := main.includedPaths()
+	if err != nil {
+		return "", err
+	}
+	contents := [][]byte{main.data}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		contents = append(contents, data)
+	}
+	return configHash(contents), nil
+}
+
+// Rollback applies again the configuration used before the running one.
+// Rolling back repeatedly goes further back in the history. A change of
+// the config files replaces the rolled back configuration again.
+func (l *EnvLoader) Rollback() (ConfigRevision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	env := l.env
+	i := l.history.previous()
+	if i < 0 {
+		return ConfigRevision{}, fmt.Errorf("no previous configuration to roll back to")
+	}
+	revision := &l.history.revisions[i]
+	if err := env.SetConfig(revision.config.Clone()); err != nil {
+		return ConfigRevision{}, fmt.Errorf("cannot roll back to configuration %.12s: %w", revision.Hash, err)
+	}
+	l.history.rolledBack(i)
+	env.Warn("Rolled back to configuration", "hash", revision.Hash[:12], "applied_at", revision.AppliedAt.Format(time.RFC3339))
+	return *revision, nil
+}
+
+// Reload reloads the configuration now, like on SIGHUP, and returns
+// the result.
+func (l *EnvLoader) Reload() error {
+	result := make(chan error, 1)
+	select {
+	case l.reloads <- result:
+		return <-result
+	case <-l.ctx.Done():
+		return fmt.Errorf("configuration loader is stopped")
+	}
+}
+
 func (l *EnvLoader) Stop() {
 	l.cancel()
 }
 
-func (l *EnvLoader) runWatcher() {
+// changedFile polls the watched files and returns the first changed one.
+// Files replaced by another one are detected even with the same size and
+// modification time.
+func (l *EnvLoader) changedFile() string {
+	env := l.env
+	changed := ""
+	for path, lastStat := range l.watched {
+		stat, err := os.Stat(path)
+		if err != nil {
+			if lastStat != nil {
+				env.Warn("Cannot stat config file", "error", err)
+			}
+			l.watched[path] = nil
+		} else if lastStat == nil || stat.Size() != lastStat.Size() || stat.ModTime() != lastStat.ModTime() || !os.SameFile(stat, lastStat) {
+			if changed == "" {
+				changed = path
+			}
+			l.watched[path] = stat
+		}
+	}
+	return changed
+}
+
+func (l *EnvLoader) watchedPaths() []string {
+	paths := make([]string, 0, len(l.watched))
+	for path := range l.watched {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// runWatcher reloads the config on changes of the watched files, reported by
+// file events or found by polling when the events are not available, on
+// changes of pattern lists, on SIGHUP and on Reload. File events are debounced, as
+// editors often write a file in several steps.
+func (l *EnvLoader) runWatcher(files *fileWatcher, hup <-chan os.Signal) {
 	env := l.env
+	defer files.close()
+	files.update(env, l.watchedPaths())
+	// polling is disabled without a period
+	var pollTicks <-chan time.Time
+	if l.pollPeriod > 0 {
+		poll := time.NewTicker(l.pollPeriod)
+		defer poll.Stop()
+		pollTicks = poll.C
+	}
+	var debounce <-chan time.Time
+	touched := false
 	for {
+		reload := false
+		var result chan<- error
 		select {
 		case <-l.ctx.Done():
 			return
-		case <-time.After(l.pollPeriod):
-			//noop
+		case <-hup:
+			env.Info("Received SIGHUP, reloading")
+			l.changedFile()
+			reload = true
+		case result = <-l.reloads:
+			env.Info("Reload requested")
+			l.changedFile()
+			reload = true
+		case event, ok := <-files.events():
+			if !ok {
+				continue
+			}
+			// events of other files in the watched directories, like a log
+			// file, are not logged, as it would cause more events
+			if files.concerns(event) {
+				env.Debug("File event", "event", event.String())
+				touched = true
+			}
+			if debounce == nil {
+				debounce = time.After(reloadDebounce)
+			}
+		case err, ok := <-files.errors():
+			if !ok {
+				continue
+			}
+			// events may have been lost
+			env.Warn("File watching failed", "error", err)
+			touched = true
+			if debounce == nil {
+				debounce = time.After(reloadDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			if path := l.changedFile(); path != "" {
+				env.Info("Detected changes in config file, reloading", "path", path)
+				reload = true
+			} else if touched {
+				env.Info("Detected writes to config files, reloading")
+				reload = true
+			}
+			touched = false
+		case <-pollTicks:
+			env.Debug("Polling for changes")
+			if !files.available() {
+				if path := l.changedFile(); path != "" {
+					env.Info("Detected changes in config file, reloading", "path", path)
+					reload = true
+				}
+			}
+			l.remoteLists.refresh(env, env.Config().PatternRefresh())
+		case <-l.remoteLists.changed:
+			env.Info("Detected changes in pattern lists, reloading")
+			reload = true
 		}
-		env.Debug("Polling for changes")
-		stat, err := os.Stat(l.configFilePath)
+		if !reload {
+			continue
+		}
+		err := l.reload()
 		if err != nil {
-			env.Warn("Cannot stat config file: %v", err)
-		} else if l.lastStat == nil || stat.Size() != l.lastStat.Size() || stat.ModTime() != l.lastStat.ModTime() {
-			env.Info("Detected changes in config file `%s`, reloading", l.configFilePath)
-			if err := loadConfig(l.env, l.configFilePath); err != nil {
-				env.Warn("Cannot load config file: %v", err)
-			}
+			env.Warn("Cannot load config file", "error", err)
+		}
+		if result != nil {
+			result <- err
 		}
-		l.lastStat = stat
+		files.update(env, l.watchedPaths())
 	}
 }
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestCheckConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+[[Rules]]
+Patterns = [".corp"]
+[[Rules]]
+Patterns = ["a.corp"]
+`)
+	problems, err := CheckConfig(ConfigSource{Path: path}, environment.NewLogger(io.Discard, ""))
+	if err != nil {
+		t.Fatalf("Failed to check config: %v", err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "shadowed") {
+		t.Fatalf("Shadowed pattern should be reported, got %q", problems)
+	}
+}
+
+func TestCheckConfig_UnknownFields(t *testing.T) {
+	path := writeTestConfig(t, `
+[[Rules]]
+Pattern = [".corp"]
+`)
+	if _, err := LoadEnvironment(ConfigSource{Path: path}, environment.NewLogger(io.Discard, "")); err != nil {
+		t.Fatalf("Unknown fields should be ignored when loading config, got %v", err)
+	}
+	if _, err := CheckConfig(ConfigSource{Path: path}, environment.NewLogger(io.Discard, "")); err == nil || !strings.Contains(err.Error(), "Rules.Pattern") {
+		t.Fatalf("Unknown fields should be reported, got %v", err)
+	}
+}
+
+func waitForProxyAddr(t *testing.T, l *EnvLoader, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if rules := l.Env().Config().Rules; len(rules) > 0 && rules[0].ProxyAddr() == addr {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Config with proxy `%s` should be reloaded, got %+v", addr, l.Env().Config().Rules)
+}
+
+func startTestWatcher(t *testing.T, path string, events bool) (*EnvLoader, chan os.Signal) {
+	l, err := newEnvLoader(ConfigSource{Path: path}, time.Hour, environment.NewLogger(io.Discard, ""), false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	t.Cleanup(l.Stop)
+	files := &fileWatcher{}
+	if events {
+		files = newFileWatcher(l.Env())
+		if !files.available() {
+			t.Skip("File events are not available")
+		}
+		files.update(l.Env(), l.watchedPaths())
+	}
+	hup := make(chan os.Signal, 1)
+	go l.runWatcher(files, hup)
+	return l, hup
+}
+
+const proxyConfig = `
+[[Rules]]
+Proxy = "http://%s:3128"
+Patterns = ["."]
+`
+
+func TestEnvLoader_ReloadOnRename(t *testing.T) {
+	path := writeTestConfig(t, fmt.Sprintf(proxyConfig, "a.test"))
+	l, _ := startTestWatcher(t, path, true)
+	waitForProxyAddr(t, l, "a.test:3128")
+	stat, _ := os.Stat(path)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf(proxyConfig, "b.test")), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	// same size and modification time, only the file is different
+	_ = os.Chtimes(tmp, stat.ModTime(), stat.ModTime())
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Failed to replace config: %v", err)
+	}
+	waitForProxyAddr(t, l, "b.test:3128")
+}
+
+func TestEnvLoader_ReloadOnSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	for _, version := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	_ = os.WriteFile(filepath.Join(dir, "v1", "proxy.toml"), []byte(fmt.Sprintf(proxyConfig, "a.test")), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "v2", "proxy.toml"), []byte(fmt.Sprintf(proxyConfig, "b.test")), 0o644)
+	// the layout of Kubernetes ConfigMap volumes
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Skipf("Symlinks are not supported: %v", err)
+	}
+	path := filepath.Join(dir, "proxy.toml")
+	_ = os.Symlink(filepath.Join("..data", "proxy.toml"), path)
+	l, _ := startTestWatcher(t, path, true)
+	waitForProxyAddr(t, l, "a.test:3128")
+	_ = os.Symlink("v2", filepath.Join(dir, "..data_tmp"))
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("Failed to swap symlink: %v", err)
+	}
+	waitForProxyAddr(t, l, "b.test:3128")
+}
+
+func TestEnvLoader_ReloadOnSighup(t *testing.T) {
+	path := writeTestConfig(t, fmt.Sprintf(proxyConfig, "a.test"))
+	l, hup := startTestWatcher(t, path, false)
+	stat, _ := os.Stat(path)
+	// an in-place change, which polling cannot detect
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(proxyConfig, "b.test")), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	_ = os.Chtimes(path, stat.ModTime(), stat.ModTime())
+	hup <- syscall.SIGHUP
+	waitForProxyAddr(t, l, "b.test:3128")
+}
+
+func TestEnvLoader_WithoutPolling(t *testing.T) {
+	path := writeTestConfig(t, fmt.Sprintf(proxyConfig, "a.test"))
+	l, err := newEnvLoader(ConfigSource{Path: path}, 0, environment.NewLogger(io.Discard, ""), false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	defer l.Stop()
+	hup := make(chan os.Signal, 1)
+	go l.runWatcher(&fileWatcher{}, hup)
+	_ = os.WriteFile(path, []byte(fmt.Sprintf(proxyConfig, "b.test")), 0o644)
+	hup <- syscall.SIGHUP
+	waitForProxyAddr(t, l, "b.test:3128")
+}
+
+func TestEnvLoader_Rollback(t *testing.T) {
+	path := writeTestConfig(t, fmt.Sprintf(proxyConfig, "a.test"))
+	l, err := newEnvLoader(ConfigSource{Path: path}, time.Hour, environment.NewLogger(io.Discard, ""), false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	defer l.Stop()
+	if _, err := l.Rollback(); err == nil {
+		t.Fatalf("Rollback without previous config should fail")
+	}
+	first := l.Status().Current.Hash
+	for _, content := range []string{fmt.Sprintf(proxyConfig, "b.test"), fmt.Sprintf(proxyConfig, "c.test"), "Rules = 1"} {
+		_ = os.WriteFile(path, []byte(content), 0o644)
+		_ = l.reload()
+	}
+	status := l.Status()
+	if len(status.History) != 3 || status.LastError == "" || !status.Modified {
+		t.Fatalf("Status should have 3 applied configs, the error and modified file, got %+v", status)
+	}
+	if l.Env().Config().Rules[0].ProxyAddr() != "c.test:3128" {
+		t.Fatalf("Failed reload should keep the last applied config")
+	}
+	if _, err := l.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if addr := l.Env().Config().Rules[0].ProxyAddr(); addr != "b.test:3128" {
+		t.Fatalf("Rollback should apply the previous config, got `%s`", addr)
+	}
+	if status := l.Status(); status.LastError != "" {
+		t.Fatalf("Rollback should clear the reload error, got `%s`", status.LastError)
+	}
+	if l.Env().Config() == l.history.revisions[1].config {
+		t.Fatalf("Rollback should apply a copy of the config kept in the history")
+	}
+	revision, err := l.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if addr := l.Env().Config().Rules[0].ProxyAddr(); addr != "a.test:3128" || revision.Hash != first {
+		t.Fatalf("Second rollback should apply the first config, got `%s`", addr)
+	}
+	if status := l.Status(); !status.History[1].RolledBack || !status.History[2].RolledBack || status.Current.Hash != first {
+		t.Fatalf("Rolled back configs should be marked, got %+v", status)
+	}
+	if _, err := l.Rollback(); err == nil {
+		t.Fatalf("Rollback past the first config should fail")
+	}
+}
+
+func TestEnvLoader_ConfigHash(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+[[Rules]]
+PatternFiles = ["corp.txt"]
+`,
+		"corp.txt": ".corp\n",
+	})
+	t.Setenv("FLEXI_CONNECT_TIMEOUT_MILLIS", "2000")
+	l, err := newEnvLoader(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, time.Hour, environment.NewLogger(io.Discard, ""), false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	defer l.Stop()
+	hashes := map[string]bool{l.Status().Current.Hash: true}
+	t.Setenv("FLEXI_CONNECT_TIMEOUT_MILLIS", "3000")
+	if err := l.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	hashes[l.Status().Current.Hash] = true
+	_ = os.WriteFile(filepath.Join(dir, "corp.txt"), []byte(".corp\n.internal\n"), 0o644)
+	if err := l.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	status := l.Status()
+	hashes[status.Current.Hash] = true
+	if len(hashes) != 3 {
+		t.Fatalf("Changed variables and pattern files should change the hash, got %+v", status.History)
+	}
+	if status.Modified {
+		t.Fatalf("Config files should not be modified, got %+v", status)
+	}
+	if err := l.reload(); err != nil || l.Status().Current.Hash != status.Current.Hash {
+		t.Fatalf("The same config should have the same hash, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"github.com/psvo/flexi-proxy/internal/environment"
+)
+
+// Explanation describes how the dialer for a target was chosen.
+type Explanation struct {
+	Target string `json:"target"`
+	Client string `json:"client,omitempty"`
+	// the IP address of the target, if some rule needed it
+	IP    string                       `json:"ip"`
+	Rules []environment.RuleEvaluation `json:"rules"`
+	// index of the matching rule, -1 if no rule matches
+	Rule   int    `json:"rule"`
+	Dialer string `json:"dialer"`
+}
+
+// Explain resolves the dialer for the target like ResolveDialer does,
+// recording the evaluation of the rules.
+func Explain(env *environment.Environment, target Target, client string) *Explanation {
+	req := newRequest(env, target, client)
+	evaluations, i, rule := env.ExplainProxyRule(req)
+	return &Explanation{
+		Target: target.String(),
+		Client: client,
+		IP:     req.IP.String(),
+		Rules:  evaluations,
+		Rule:   i,
+		Dialer: dialerForRule(env, rule, target).String(),
+	}
+}
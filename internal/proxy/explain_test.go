@@ -0,0 +1,78 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	err := env.SetConfig(&environment.Config{Rules: []environment.Rule{
+		{Proxy: "http://corp.test:3128", Patterns: []string{".corp", "10.0.0.0/8"}, Ports: []string{"443"}},
+		{Patterns: []string{"other.test"}},
+		{Proxy: "http://default.test:3128", Patterns: []string{"."}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	target, err := ParseTarget("intranet.corp:80", "")
+	if err != nil {
+		t.Fatalf("Failed to parse target: %v", err)
+	}
+	explanation := Explain(env, target, "")
+	if explanation.Rule != 2 || explanation.Dialer != "PROXY http://default.test:3128" {
+		t.Fatalf("Target should use rule[2], got rule[%d] `%s`", explanation.Rule, explanation.Dialer)
+	}
+	if explanation.IP != "<unresolved>" {
+		t.Fatalf("Domain patterns should not need the IP, got `%s`", explanation.IP)
+	}
+	expected := []environment.RuleEvaluation{
+		{Rule: 0, Proxy: "http://corp.test:3128", Pattern: ".corp", Reason: "not port 80"},
+		{Rule: 1, Reason: "no pattern matches"},
+		{Rule: 2, Proxy: "http://default.test:3128", Pattern: ".", Matched: true},
+	}
+	if len(explanation.Rules) != len(expected) {
+		t.Fatalf("Expected %d evaluated rules, got %+v", len(expected), explanation.Rules)
+	}
+	for i, e := range expected {
+		if explanation.Rules[i] != e {
+			t.Fatalf("Rule evaluation should be %+v, got %+v", e, explanation.Rules[i])
+		}
+	}
+}
+
+func TestExplain_NoMatch(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	err := env.SetConfig(&environment.Config{Rules: []environment.Rule{
+		{Proxy: "http://corp.test:3128", Patterns: []string{".corp"}},
+		{Patterns: []string{".test"}, Ports: []string{"443"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	target, err := ParseTarget("a.test:80", "")
+	if err != nil {
+		t.Fatalf("Failed to parse target: %v", err)
+	}
+	explanation := Explain(env, target, "")
+	if explanation.Rule != -1 || explanation.Dialer != "DIRECT" {
+		t.Fatalf("Target should not match any rule, got rule[%d] `%s`", explanation.Rule, explanation.Dialer)
+	}
+	expected := []environment.RuleEvaluation{
+		{Rule: 0, Proxy: "http://corp.test:3128", Reason: "no pattern matches"},
+		{Rule: 1, Pattern: ".test", Reason: "not port 80"},
+	}
+	if len(explanation.Rules) != len(expected) {
+		t.Fatalf("Expected %d evaluated rules, got %+v", len(expected), explanation.Rules)
+	}
+	for i, e := range expected {
+		if explanation.Rules[i] != e {
+			t.Fatalf("Rule evaluation should be %+v, got %+v", e, explanation.Rules[i])
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"os"
+	"path/filepath"
+)
+
+// fileWatcher receives change events of the watched files. It watches their
+// directories, so files replaced by a rename are noticed as well as swapped
+// symlinks, like the `..data` link of Kubernetes ConfigMap volumes. Without
+// the event support the files need to be polled.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	// watched directories
+	dirs map[string]bool
+	// watched files, including the targets of symlinks
+	names map[string]bool
+}
+
+func newFileWatcher(env *environment.Environment) *fileWatcher {
+	w := &fileWatcher{
+		dirs:  map[string]bool{},
+		names: map[string]bool{},
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		env.Warn("File change events are not available, polling", "error", err)
+		return w
+	}
+	w.watcher = watcher
+	return w
+}
+
+// available reports whether the files do not need to be polled.
+func (w *fileWatcher) available() bool {
+	return w.watcher != nil
+}
+
+func (w *fileWatcher) events() <-chan fsnotify.Event {
+	if w.watcher == nil {
+		return nil
+	}
+	return w.watcher.Events
+}
+
+func (w *fileWatcher) errors() <-chan error {
+	if w.watcher == nil {
+		return nil
+	}
+	return w.watcher.Errors
+}
+
+// update watches the directories of the files, including the targets of
+// symlinks, and the watched directories themselves. When a directory cannot
+// be watched, events are turned off.
+func (w *fileWatcher) update(env *environment.Environment, paths []string) {
+	if w.watcher == nil {
+		return
+	}
+	names := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		names[filepath.Clean(path)] = true
+		dirs[filepath.Dir(path)] = true
+		if stat, err := os.Stat(path); err == nil && stat.IsDir() {
+			dirs[filepath.Clean(path)] = true
+		}
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			names[target] = true
+			dirs[filepath.Dir(target)] = true
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			_ = w.watcher.Remove(dir)
+		}
+	}
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			env.Warn("Cannot watch directory, polling", "path", dir, "error", err)
+			w.close()
+			return
+		}
+	}
+	w.dirs, w.names = dirs, names
+}
+
+// concerns reports whether the event is about some of the watched files.
+// Other events of the directories may still affect them via symlinks.
+func (w *fileWatcher) concerns(event fsnotify.Event) bool {
+	return w.names[filepath.Clean(event.Name)] && event.Op != fsnotify.Chmod
+}
+
+func (w *fileWatcher) close() {
+	if w.watcher != nil {
+		_ = w.watcher.Close()
+		w.watcher = nil
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"strings"
+	"time"
+)
+
+// configHistorySize is the number of applied configs kept for rollbacks.
+const configHistorySize = 10
+
+// ConfigRevision is a configuration applied by the loader.
+type ConfigRevision struct {
+	// SHA-256 of the configuration as applied, including the overrides,
+	// system proxy rules and pattern lists
+	Hash      string    `json:"hash"`
+	AppliedAt time.Time `json:"appliedAt"`
+	// whether the configuration was replaced by a rollback
+	RolledBack bool `json:"rolledBack"`
+	// config as applied, it is in use or it was, so it is never changed
+	config *environment.Config
+	// filesHash is the hash of the configuration files it was loaded from
+	filesHash string
+}
+
+// ReloadStatus describes the running configuration and the previous ones.
+type ReloadStatus struct {
+	Current *ConfigRevision  `json:"current"`
+	History []ConfigRevision `json:"history"`
+	// hash of the configuration files now, which may not be applied yet,
+	// Modified compares it with the files of the current configuration
+	FileHash    string    `json:"fileHash"`
+	Modified    bool      `json:"modified"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+}
+
+type configHistory struct {
+	revisions []ConfigRevision
+	// index of the running revision, -1 before any is applied
+	current int
+	// lastError is the failure of the last reload, cleared by applying
+	// a config
+	lastError   error
+	lastErrorAt time.Time
+}
+
+func newConfigHistory() *configHistory {
+	return &configHistory{
+		current: -1,
+	}
+}
+
+// effectiveConfigHash hashes the config as it is used, encoded with
+// the patterns loaded from the pattern lists of the rules.
+func effectiveConfigHash(cfg *environment.Config) (string, error) {
+	var encoded bytes.Buffer
+	if err := EncodeConfig(&encoded, cfg, FormatToml); err != nil {
+		return "", err
+	}
+	contents := [][]byte{encoded.Bytes()}
+	for i := range cfg.Rules {
+		contents = append(contents, []byte(strings.Join(cfg.Rules[i].ListPatterns(), "\n")))
+	}
+	return configHash(contents), nil
+}
+
+func configHash(contents [][]byte) string {
+	hash := sha256.New()
+	for _, data := range contents {
+		_, _ = fmt.Fprintf(hash, "%d:", len(data))
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (h *configHistory) applied(hash string, filesHash string, cfg *environment.Config) *ConfigRevision {
+	h.revisions = append(h.revisions, ConfigRevision{
+		Hash:      hash,
+		AppliedAt: time.Now(),
+		config:    cfg,
+		filesHash: filesHash,
+	})
+	if n := len(h.revisions); n > configHistorySize {
+		h.revisions = h.revisions[n-configHistorySize:]
+	}
+	h.current = len(h.revisions) - 1
+	h.lastError = nil
+	return &h.revisions[h.current]
+}
+
+// rolledBack marks the running revision as rolled back to the revision.
+func (h *configHistory) rolledBack(i int) {
+	h.revisions[h.current].RolledBack = true
+	h.current = i
+	h.lastError = nil
+}
+
+func (h *configHistory) failed(err error) {
+	h.lastError = err
+	h.lastErrorAt = time.Now()
+}
+
+// previous returns the index of the last revision applied before the running
+// one which was not rolled back, or -1.
+func (h *configHistory) previous() int {
+	for i := h.current - 1; i >= 0; i-- {
+		if !h.revisions[i].RolledBack {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *configHistory) status() ReloadStatus {
+	status := ReloadStatus{
+		History: append([]ConfigRevision(nil), h.revisions...),
+	}
+	if h.current >= 0 {
+		status.Current = &status.History[h.current]
+	}
+	if h.lastError != nil {
+		status.LastError = h.lastError.Error()
+		status.LastErrorAt = h.lastErrorAt
+	}
+	return status
+}
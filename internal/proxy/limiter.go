@@ -0,0 +1,445 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"golang.org/x/time/rate"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Rejection is the error of rejecting a connection by a limit.
+type Rejection struct {
+	// Reason labels the rejected connections metric
+	Reason  string
+	message string
+}
+
+func (r *Rejection) Error() string {
+	return r.message
+}
+
+// Reasons of rejecting connections by the limiter.
+var (
+	ErrClientRate        = &Rejection{Reason: "client_rate", message: "client connection rate exceeded"}
+	ErrClientConnections = &Rejection{Reason: "client_connections", message: "too many client connections"}
+	// the proxy is overloaded by these
+	ErrMaxConnections         = &Rejection{Reason: "max_connections", message: "too many connections"}
+	ErrListenerConnections    = &Rejection{Reason: "listener_connections", message: "too many connections of the listener"}
+	ErrDestinationConnections = &Rejection{Reason: "destination_connections", message: "too many connections to the destination"}
+	ErrQueueFull              = &Rejection{Reason: "queue_full", message: "too many connections waiting in the queue"}
+)
+
+// shapedChunk is the largest transfer passed by the token buckets at once,
+// the buckets hold at least this many bytes.
+const shapedChunk = 16 * 1024
+
+// clientStatePeriod is how long the state of a client or a rule without
+// connections is kept, its buckets are full again by then.
+const clientStatePeriod = time.Minute
+
+// Limiter admits new connections by the connection limits and shapes their
+// bandwidth by token buckets. The buckets persist across config reloads,
+// their rates follow the current config. The buckets of a rule are kept
+// while the rule is unchanged, see Rule.Key.
+type Limiter struct {
+	mu     sync.Mutex
+	global bandwidthBuckets
+	// rules holds the buckets of the rules by their keys
+	rules     map[string]*ruleState
+	clients   map[string]*clientState
+	lastPrune time.Time
+	// connections holds the slots of accepted connections, also by
+	// the listeners, destinations holds the slots by the destinations
+	connections  int
+	listeners    map[string]int
+	destinations map[string]int
+	// released is closed when a slot is released, it is created by
+	// waiting connections
+	released chan struct{}
+}
+
+type bandwidthBuckets struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+type ruleState struct {
+	bandwidth  bandwidthBuckets
+	active     int
+	lastActive time.Time
+}
+
+type clientState struct {
+	bandwidth   bandwidthBuckets
+	connections *rate.Limiter
+	active      int
+	lastActive  time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		global:       newBandwidthBuckets(),
+		rules:        map[string]*ruleState{},
+		clients:      map[string]*clientState{},
+		listeners:    map[string]int{},
+		destinations: map[string]int{},
+	}
+}
+
+func newBandwidthBuckets() bandwidthBuckets {
+	return bandwidthBuckets{
+		upload:   rate.NewLimiter(rate.Inf, 0),
+		download: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+// update sets the rates of the buckets to the bandwidth.
+func (b *bandwidthBuckets) update(bandwidth environment.Bandwidth) {
+	setRate(&b.upload, bandwidth.Upload, shapedChunk)
+	setRate(&b.download, bandwidth.Download, shapedChunk)
+}
+
+// setRate sets the rate of the bucket holding a second worth of tokens,
+// at least the minimum burst. No rate, zero or negative, means no limit.
+// A bucket which had no limit is replaced by a full one.
+func setRate(bucket **rate.Limiter, perSecond int, minBurst int) {
+	limit, burst := rate.Inf, 0
+	if perSecond > 0 {
+		limit, burst = rate.Limit(perSecond), perSecond
+		if burst < minBurst {
+			burst = minBurst
+		}
+	}
+	b := *bucket
+	switch {
+	case b.Limit() == limit && b.Burst() == burst:
+	case b.Limit() == rate.Inf:
+		*bucket = rate.NewLimiter(limit, burst)
+	default:
+		b.SetLimit(limit)
+		b.SetBurst(burst)
+	}
+}
+
+// Admit admits a new connection of the client, by its remote address, within
+// the client connection limits of the config. The returned function releases
+// the connection.
+func (l *Limiter) Admit(cfg *environment.Config, client string) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.client(client)
+	if limit := cfg.ClientMaxConnections; limit > 0 && state.active >= limit {
+		return nil, ErrClientConnections
+	}
+	setRate(&state.connections, cfg.ClientConnectionsPerSecond, 1)
+	if !state.connections.Allow() {
+		return nil, ErrClientRate
+	}
+	state.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			state.active--
+			state.lastActive = time.Now()
+		})
+	}, nil
+}
+
+// AcquireConnection takes a slot of an accepted connection within the limits
+// of all listeners and of the listener, given by listenerMax. See acquire.
+func (l *Limiter) AcquireConnection(ctx context.Context, cfg *environment.Config, listener string, listenerMax int) (release func(), err error) {
+	return l.acquire(ctx, cfg, func() error {
+		switch {
+		case cfg.MaxConnections > 0 && l.connections >= cfg.MaxConnections:
+			return ErrMaxConnections
+		case listenerMax > 0 && l.listeners[listener] >= listenerMax:
+			return ErrListenerConnections
+		}
+		l.connections++
+		l.listeners[listener]++
+		return nil
+	}, func() {
+		l.connections--
+		if l.listeners[listener]--; l.listeners[listener] == 0 {
+			delete(l.listeners, listener)
+		}
+	})
+}
+
+// AcquireDestination takes a slot of a tunnel or a request to the destination
+// address, normalized as `host:port`. See acquire.
+func (l *Limiter) AcquireDestination(ctx context.Context, cfg *environment.Config, destination string) (release func(), err error) {
+	return l.acquire(ctx, cfg, func() error {
+		if limit := cfg.DestinationMaxConnections; limit > 0 && l.destinations[destination] >= limit {
+			return ErrDestinationConnections
+		}
+		l.destinations[destination]++
+		return nil
+	}, func() {
+		if l.destinations[destination]--; l.destinations[destination] == 0 {
+			delete(l.destinations, destination)
+		}
+	})
+}
+
+// acquire takes a slot by the take function, called with the mutex locked,
+// which returns the error of a reached limit. When a limit is reached, it
+// waits for a released slot until the queue timeout or until the context is
+// done. The returned function releases the slot by the free function.
+func (l *Limiter) acquire(ctx context.Context, cfg *environment.Config, take func() error, free func()) (release func(), err error) {
+	var timeout <-chan time.Time
+	if d := cfg.QueueTimeout(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		l.mu.Lock()
+		err := take()
+		if err == nil {
+			l.mu.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() { l.release(free) })
+			}, nil
+		}
+		if timeout == nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, err
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// release frees the slot and wakes the waiting connections.
+func (l *Limiter) release(free func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	free()
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// prune drops states of clients and rules inactive for a while.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) <= clientStatePeriod {
+		return
+	}
+	for key, state := range l.clients {
+		if state.active == 0 && now.Sub(state.lastActive) > clientStatePeriod {
+			delete(l.clients, key)
+		}
+	}
+	for key, state := range l.rules {
+		if state.active == 0 && now.Sub(state.lastActive) > clientStatePeriod {
+			delete(l.rules, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// rule returns the state of the rule by its key.
+func (l *Limiter) rule(key string) *ruleState {
+	now := time.Now()
+	l.prune(now)
+	state, ok := l.rules[key]
+	if !ok {
+		state = &ruleState{bandwidth: newBandwidthBuckets()}
+		l.rules[key] = state
+	}
+	state.lastActive = now
+	return state
+}
+
+// client returns the state of the client, by its address without the port.
+func (l *Limiter) client(client string) *clientState {
+	now := time.Now()
+	l.prune(now)
+	key := client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		key = host
+	}
+	state, ok := l.clients[key]
+	if !ok {
+		state = &clientState{
+			bandwidth:   newBandwidthBuckets(),
+			connections: rate.NewLimiter(rate.Inf, 0),
+		}
+		l.clients[key] = state
+	}
+	state.lastActive = now
+	return state
+}
+
+// Shaper limits the bandwidth of the transfers of a connection.
+type Shaper struct {
+	ctx      context.Context
+	upload   []*rate.Limiter
+	download []*rate.Limiter
+}
+
+// Shaper returns the shaper of a connection by the global limits, the limits
+// of the route's rule and the limits of the client, all by the config of
+// the route. Waiting for the buckets
+// ends when the context is done, which needs to be done by the end of
+// the connection, as the rule keeps its buckets until then.
+func (l *Limiter) Shaper(ctx context.Context, route *Route, client string) *Shaper {
+	cfg := route.Config
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &Shaper{ctx: ctx}
+	add := func(b *bandwidthBuckets, bandwidth environment.Bandwidth) {
+		b.update(bandwidth)
+		if bandwidth.Upload > 0 {
+			s.upload = append(s.upload, b.upload)
+		}
+		if bandwidth.Download > 0 {
+			s.download = append(s.download, b.download)
+		}
+	}
+	add(&l.global, cfg.Bandwidth())
+	if route.Rule >= 0 && route.Bandwidth != (environment.Bandwidth{}) {
+		rule := l.rule(route.RuleKey)
+		rule.active++
+		add(&rule.bandwidth, route.Bandwidth)
+		go func() {
+			<-ctx.Done()
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			rule.active--
+			rule.lastActive = time.Now()
+		}()
+	}
+	add(&l.client(client).bandwidth, cfg.ClientBandwidth())
+	return s
+}
+
+// Shape limits the bandwidth of the target connection, see Shaper.
+func (l *Limiter) Shape(ctx context.Context, route *Route, client string, conn net.Conn) net.Conn {
+	return l.Shaper(ctx, route, client).Conn(conn)
+}
+
+// Conn limits the bandwidth of the target connection.
+func (s *Shaper) Conn(conn net.Conn) net.Conn {
+	if len(s.upload) == 0 && len(s.download) == 0 {
+		return conn
+	}
+	return &shapedConn{Conn: conn, shaper: s}
+}
+
+// Upload limits the bandwidth of reading the body sent to the target.
+func (s *Shaper) Upload(body io.ReadCloser) io.ReadCloser {
+	if len(s.upload) == 0 {
+		return body
+	}
+	return &shapedBody{ReadCloser: body, ctx: s.ctx, buckets: s.upload}
+}
+
+// Download limits the bandwidth of reading the body received from
+// the target.
+func (s *Shaper) Download(body io.ReadCloser) io.ReadCloser {
+	if len(s.download) == 0 {
+		return body
+	}
+	return &shapedBody{ReadCloser: body, ctx: s.ctx, buckets: s.download}
+}
+
+// shapedConn waits for the upload buckets before writing to the target
+// and for the download buckets after reading from it.
+type shapedConn struct {
+	net.Conn
+	shaper *Shaper
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(c.shaper.download) == 0 {
+		return c.Conn.Read(p)
+	}
+	return readShaped(c.shaper.ctx, c.Conn, p, c.shaper.download)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if len(c.shaper.upload) == 0 {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > shapedChunk {
+			chunk = chunk[:shapedChunk]
+		}
+		if err := waitBuckets(c.shaper.ctx, c.shaper.upload, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the connection, if it is supported.
+func (c *shapedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// shapedBody waits for the buckets after reading from the body.
+type shapedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*rate.Limiter
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	return readShaped(b.ctx, b.ReadCloser, p, b.buckets)
+}
+
+// readShaped reads at most a chunk and waits for the buckets to pass it.
+func readShaped(ctx context.Context, r io.Reader, p []byte, buckets []*rate.Limiter) (int, error) {
+	if len(p) > shapedChunk {
+		p = p[:shapedChunk]
+	}
+	n, err := r.Read(p)
+	if n > 0 {
+		if waitErr := waitBuckets(ctx, buckets, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func waitBuckets(ctx context.Context, buckets []*rate.Limiter, n int) error {
+	for _, bucket := range buckets {
+		if err := bucket.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Admit(t *testing.T) {
+	l := NewLimiter()
+	cfg := &environment.Config{ClientMaxConnections: 2}
+	first, err := l.Admit(cfg, "127.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("First connection should be admitted, got %v", err)
+	}
+	if _, err := l.Admit(cfg, "127.0.0.1:5001"); err != nil {
+		t.Fatalf("Second connection should be admitted, got %v", err)
+	}
+	if _, err := l.Admit(cfg, "127.0.0.1:5002"); err != ErrClientConnections {
+		t.Fatalf("Third connection of the client should be rejected, got %v", err)
+	}
+	if _, err := l.Admit(cfg, "127.0.0.2:5000"); err != nil {
+		t.Fatalf("Connection of another client should be admitted, got %v", err)
+	}
+	first()
+	first()
+	if _, err := l.Admit(cfg, "127.0.0.1:5003"); err != nil {
+		t.Fatalf("Connection should be admitted after a release, got %v", err)
+	}
+	if _, err := l.Admit(cfg, "127.0.0.1:5004"); err != ErrClientConnections {
+		t.Fatalf("Release should be counted once, got %v", err)
+	}
+
+	cfg = &environment.Config{ClientConnectionsPerSecond: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := l.Admit(cfg, "127.0.0.3:5000"); err != nil {
+			t.Fatalf("Connection %d should be admitted, got %v", i, err)
+		}
+	}
+	if _, err := l.Admit(cfg, "127.0.0.3:5000"); err != ErrClientRate {
+		t.Fatalf("Connection over the rate should be rejected, got %v", err)
+	}
+}
+
+func TestLimiter_Shape(t *testing.T) {
+	l := NewLimiter()
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	route := &Route{Rule: -1, Config: &environment.Config{}}
+	if conn := l.Shape(context.Background(), route, "127.0.0.1:5000", client); conn != client {
+		t.Fatalf("Connection without limits should not be shaped")
+	}
+
+	// the burst passes the first chunk right away, the rest takes a second
+	route.Config = &environment.Config{ClientDownloadLimitKBps: 16}
+	conn := l.Shape(context.Background(), route, "127.0.0.1:5000", client)
+	go func() { _, _ = server.Write(make([]byte, 2*shapedChunk)) }()
+	start := time.Now()
+	if _, err := io.ReadFull(conn, make([]byte, 2*shapedChunk)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("Download should be limited, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	route.Config = &environment.Config{UploadLimitKBps: 16}
+	conn = l.Shape(ctx, route, "127.0.0.1:5000", client)
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	if _, err := conn.Write(make([]byte, shapedChunk)); err != nil {
+		t.Fatalf("Burst should be written, got %v", err)
+	}
+	cancel()
+	if _, err := conn.Write(make([]byte, shapedChunk)); err == nil {
+		t.Fatalf("Waiting for the limit should end with the context")
+	}
+}
+
+func TestLimiter_ShaperReload(t *testing.T) {
+	l := NewLimiter()
+	ctx, cancel := context.WithCancel(context.Background())
+	route := &Route{Rule: 0, RuleKey: "0:a", Bandwidth: environment.Bandwidth{Upload: 16 * 1024}, Config: &environment.Config{}}
+	first := l.Shaper(ctx, route, "127.0.0.1:5000")
+	reloaded := *route
+	reloaded.Config = &environment.Config{Verbosity: environment.Debug}
+	if same := l.Shaper(ctx, &reloaded, "127.0.0.1:5001"); same.upload[0] != first.upload[0] {
+		t.Fatalf("Connections of the rule should share its buckets in any config with the rule")
+	}
+	changed := &Route{Rule: 0, RuleKey: "0:b", Bandwidth: route.Bandwidth, Config: route.Config}
+	if other := l.Shaper(ctx, changed, "127.0.0.1:5000"); other.upload[0] == first.upload[0] {
+		t.Fatalf("Rule buckets should not be shared with a changed rule of the same index")
+	}
+	if again := l.Shaper(ctx, route, "127.0.0.1:5000"); again.upload[0] != first.upload[0] {
+		t.Fatalf("Rule buckets should be kept while the rule is used")
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	l.mu.Lock()
+	l.rules["0:a"].lastActive = time.Now().Add(-2 * clientStatePeriod)
+	l.lastPrune = time.Time{}
+	l.mu.Unlock()
+	if pruned := l.Shaper(context.Background(), changed, "127.0.0.1:5000"); len(l.rules) != 1 || pruned.upload[0] == first.upload[0] {
+		t.Fatalf("Buckets of a rule inactive for a while should be dropped, got %d rules", len(l.rules))
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	l := NewLimiter()
+	ctx := context.Background()
+	cfg := &environment.Config{MaxConnections: 3, DestinationMaxConnections: 1}
+	first, err := l.AcquireConnection(ctx, cfg, "http", 2)
+	if err != nil {
+		t.Fatalf("First connection should be acquired, got %v", err)
+	}
+	if _, err := l.AcquireConnection(ctx, cfg, "http", 2); err != nil {
+		t.Fatalf("Second connection should be acquired, got %v", err)
+	}
+	if _, err := l.AcquireConnection(ctx, cfg, "http", 2); err != ErrListenerConnections {
+		t.Fatalf("Third connection of the listener should be rejected, got %v", err)
+	}
+	if _, err := l.AcquireConnection(ctx, cfg, "socks", 0); err != nil {
+		t.Fatalf("Connection of another listener should be acquired, got %v", err)
+	}
+	if _, err := l.AcquireConnection(ctx, cfg, "socks", 0); err != ErrMaxConnections {
+		t.Fatalf("Connection over the maximum should be rejected, got %v", err)
+	}
+	if _, err := l.AcquireDestination(ctx, cfg, "a.test:443"); err != nil {
+		t.Fatalf("First connection to the destination should be acquired, got %v", err)
+	}
+	if _, err := l.AcquireDestination(ctx, cfg, "a.test:443"); err != ErrDestinationConnections {
+		t.Fatalf("Second connection to the destination should be rejected, got %v", err)
+	}
+	if _, err := l.AcquireDestination(ctx, cfg, "b.test:443"); err != nil {
+		t.Fatalf("Connection to another destination should be acquired, got %v", err)
+	}
+
+	cfg.QueueTimeoutMillis = 5_000
+	time.AfterFunc(50*time.Millisecond, first)
+	if _, err := l.AcquireConnection(ctx, cfg, "http", 2); err != nil {
+		t.Fatalf("Queued connection should be acquired after a release, got %v", err)
+	}
+	cfg.QueueTimeoutMillis = 50
+	start := time.Now()
+	if _, err := l.AcquireConnection(ctx, cfg, "socks", 0); err != ErrMaxConnections || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Queued connection should be rejected after the timeout, got %v", err)
+	}
+}
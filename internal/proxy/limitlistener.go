@@ -0,0 +1,211 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rejectTimeout limits replying to a rejected connection.
+const rejectTimeout = time.Second
+
+// LimitListener limits the accepted connections of the listener, named
+// listener, by the connection limits of all listeners and of the listener,
+// given by listenerMax. Like netutil.LimitListener, but the connections over
+// a limit wait in a queue for a free slot until the queue timeout, then they
+// are replied by the reject function and closed. Connections over the queue
+// limit are rejected right away. A connection holds its slot until it is
+// closed, including handshakes, unless it releases it by IdleConn.
+func (l *Limiter) LimitListener(env *environment.Environment, inner net.Listener, listener string, listenerMax func(*environment.Config) int, reject func(conn net.Conn)) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	ll := &limitedListener{
+		Listener:    inner,
+		limiter:     l,
+		env:         env,
+		name:        listener,
+		listenerMax: listenerMax,
+		reject:      reject,
+		ctx:         ctx,
+		cancel:      cancel,
+		accepted:    make(chan acceptResult),
+	}
+	go ll.run()
+	return ll
+}
+
+type limitedListener struct {
+	net.Listener
+	limiter     *Limiter
+	env         *environment.Environment
+	name        string
+	listenerMax func(*environment.Config) int
+	reject      func(conn net.Conn)
+	// ctx is canceled by closing the listener, it stops the queued
+	// connections
+	ctx      context.Context
+	cancel   context.CancelFunc
+	accepted chan acceptResult
+	// queued counts the connections waiting for a slot or for Accept
+	queued atomic.Int32
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// run accepts the connections and queues them for their slots.
+func (l *limitedListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptResult{err: err}:
+			case <-l.ctx.Done():
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if limit := l.env.Config().QueueMaxConnections; limit > 0 && int(l.queued.Load()) >= limit {
+			go l.rejectConn(conn, ErrQueueFull)
+			continue
+		}
+		l.queued.Add(1)
+		go l.queue(conn)
+	}
+}
+
+// queue waits for a slot of the connection and passes it to Accept, or it
+// rejects the connection by a limit.
+func (l *limitedListener) queue(conn net.Conn) {
+	defer l.queued.Add(-1)
+	cfg := l.env.Config()
+	release, err := l.limiter.AcquireConnection(l.ctx, cfg, l.name, l.listenerMax(cfg))
+	if err != nil {
+		if l.ctx.Err() != nil {
+			_ = conn.Close()
+			return
+		}
+		l.rejectConn(conn, err)
+		return
+	}
+	select {
+	case l.accepted <- acceptResult{conn: &limitedConn{Conn: conn, listener: l, release: release}}:
+	case <-l.ctx.Done():
+		release()
+		_ = conn.Close()
+	}
+}
+
+// rejectConn replies to the connection rejected by a limit, for at most
+// rejectTimeout, and closes it.
+func (l *limitedListener) rejectConn(conn net.Conn, err error) {
+	l.env.Warn("Connection rejected", "listener", l.name, "client", conn.RemoteAddr().String(), "error", err)
+	metrics.ConnectionRejected(l.name, err.(*Rejection).Reason)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	l.reject(conn)
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *limitedListener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// limitedConn releases its slot when it is closed or while it is idle.
+type limitedConn struct {
+	net.Conn
+	listener *limitedListener
+	mu       sync.Mutex
+	// release frees the slot, nil while the connection holds none
+	release func()
+	closed  bool
+}
+
+func (c *limitedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.releaseSlot()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// releaseSlot frees the slot, if it is held, with the mutex locked.
+func (c *limitedConn) releaseSlot() {
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// IdleConn releases the slot of the connection accepted by a limited
+// listener while it is idle, like an HTTP keep-alive connection between
+// requests, so idle connections do not keep out others. Other connections
+// are ignored.
+func IdleConn(conn net.Conn) {
+	if c, ok := conn.(*limitedConn); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.releaseSlot()
+	}
+}
+
+// ActivateConn takes a slot again for the connection released by IdleConn.
+// It waits for a free slot like the accepted connections, until the queue
+// timeout or until the context is done, and returns the error of the limit
+// rejecting the connection.
+func ActivateConn(ctx context.Context, conn net.Conn) error {
+	c, ok := conn.(*limitedConn)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	held := c.release != nil || c.closed
+	c.mu.Unlock()
+	if held {
+		return nil
+	}
+	l := c.listener
+	cfg := l.env.Config()
+	release, err := l.limiter.AcquireConnection(ctx, cfg, l.name, l.listenerMax(cfg))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		release()
+		return nil
+	}
+	c.release = release
+	return nil
+}
+
+// CloseWrite half-closes the connection, if it is supported.
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	if err := env.SetConfig(&environment.Config{HttpMaxConnections: 1, QueueTimeoutMillis: 5_000, Rules: []environment.Rule{{Patterns: []string{"."}}}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	reject := func(conn net.Conn) { _, _ = io.WriteString(conn, "rejected") }
+	l := NewLimiter().LimitListener(env, inner, "http", func(cfg *environment.Config) int { return cfg.HttpMaxConnections }, reject)
+	defer func() { _ = l.Close() }()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	dial()
+	first := <-accepted
+	dial()
+	select {
+	case <-accepted:
+		t.Fatalf("Connection over the limit should wait in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = first.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queued connection should be accepted after closing the first one")
+	}
+
+	if err := env.SetConfig(&environment.Config{HttpMaxConnections: 1, QueueTimeoutMillis: 50, Rules: []environment.Rule{{Patterns: []string{"."}}}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	rejected := dial()
+	_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := io.ReadAll(rejected); err != nil || string(reply) != "rejected" {
+		t.Fatalf("Connection should be replied and closed after the queue timeout, got `%s` %v", reply, err)
+	}
+	_ = l.Close()
+	if _, ok := <-accepted; ok {
+		t.Fatalf("Closed listener should not accept connections")
+	}
+}
+
+func TestLimitListener_QueueFull(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	if err := env.SetConfig(&environment.Config{MaxConnections: 1, QueueTimeoutMillis: 5_000, QueueMaxConnections: 1, Rules: []environment.Rule{{Patterns: []string{"."}}}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	reject := func(conn net.Conn) { _, _ = io.WriteString(conn, "rejected") }
+	l := NewLimiter().LimitListener(env, inner, "socks", func(cfg *environment.Config) int { return cfg.SocksMaxConnections }, reject)
+	defer func() { _ = l.Close() }()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	dial()
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+	queued := dial()
+	rejected := dial()
+	_ = rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := io.ReadAll(rejected); err != nil || string(reply) != "rejected" {
+		t.Fatalf("Connection over the queue limit should be rejected right away, got `%s` %v", reply, err)
+	}
+	_ = queued.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := queued.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Connection within the queue limit should wait, got %v", err)
+	}
+}
+
+func TestLimitListener_IdleConn(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	if err := env.SetConfig(&environment.Config{HttpMaxConnections: 1, QueueTimeoutMillis: 50, Rules: []environment.Rule{{Patterns: []string{"."}}}}); err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	l := NewLimiter().LimitListener(env, inner, "http", func(cfg *environment.Config) int { return cfg.HttpMaxConnections }, func(net.Conn) {})
+	defer func() { _ = l.Close() }()
+	accept := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Connection should be accepted, got %v", err)
+		}
+		t.Cleanup(func() { _ = accepted.Close() })
+		return accepted
+	}
+
+	idle := accept()
+	IdleConn(idle)
+	active := accept()
+	if err := ActivateConn(context.Background(), idle); err != ErrListenerConnections {
+		t.Fatalf("Idle connection should wait for a slot like new ones, got %v", err)
+	}
+	_ = active.Close()
+	if err := ActivateConn(context.Background(), idle); err != nil {
+		t.Fatalf("Idle connection should take the released slot, got %v", err)
+	}
+	if err := ActivateConn(context.Background(), idle); err != nil {
+		t.Fatalf("Active connection should keep its slot, got %v", err)
+	}
+	_ = idle.Close()
+	accept()
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
+	"net"
+	"time"
+)
+
+// LookupIP returns the IP address of the host. Unless the host is an IP
+// literal, the DNS lookup is deferred until a rule actually needs the address.
+func LookupIP(env *environment.Environment, host string) *environment.LazyIP {
+	if ip := net.ParseIP(host); ip != nil {
+		return environment.StaticIP(ip)
+	}
+	return environment.NewLazyIP(func() net.IP {
+		ctx, cancel := context.WithTimeout(context.Background(), env.Config().ConnectTimeout())
+		defer cancel()
+		start := time.Now()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		metrics.ObserveLookup(start, err)
+		if err != nil {
+			env.Warn("IP lookup failed", "target", host, "error", err)
+			return nil
+		}
+		env.Debug("Looked up IP", "target", host, "ip", ips[0], "duration", time.Since(start))
+		return ips[0]
+	})
+}
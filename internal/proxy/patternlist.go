@@ -0,0 +1,371 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ignored names commonly found in hosts files
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// parsePatternList reads patterns from a list, one entry per line. Each line
+// may be in one of the following formats:
+//
+//	the.test, .the.test, 10.0.0.0/8   plain pattern as in the config file
+//	0.0.0.0 the.test other.test       hosts file, matches the names exactly
+//	||the.test^                       AdBlock, matches the domain and subdomains
+//	server=/the.test/other.test/...   dnsmasq, matches the domains and subdomains
+//
+// Empty lines and comments starting with `#` or `!` are skipped. Lines which
+// cannot be translated to patterns, like AdBlock cosmetic filters, are counted
+// as skipped.
+func parsePatternList(r io.Reader) (patterns []string, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		p := parsePatternLine(line)
+		if p == nil {
+			skipped++
+		}
+		patterns = append(patterns, p...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot read pattern list: %w", err)
+	}
+	return patterns, skipped, nil
+}
+
+func parsePatternLine(line string) []string {
+	if strings.HasPrefix(line, "||") {
+		return parseAdBlockLine(line)
+	}
+	if eq := strings.IndexByte(line, '='); eq > 0 && strings.HasPrefix(line[eq+1:], "/") {
+		return parseDnsmasqLine(line[eq+1:])
+	}
+	if hash := strings.IndexByte(line, '#'); hash >= 0 {
+		line = strings.TrimSpace(line[:hash])
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		var patterns []string
+		for _, name := range fields[1:] {
+			if !hostsFileNames[strings.ToLower(name)] {
+				patterns = append(patterns, name)
+			}
+		}
+		if patterns == nil {
+			return []string{}
+		}
+		return patterns
+	}
+	if len(fields) != 1 || strings.ContainsAny(fields[0], "@^|$*") {
+		// other AdBlock rules, like exceptions or wildcards
+		return nil
+	}
+	return fields
+}
+
+func parseAdBlockLine(line string) []string {
+	rule := line[2:]
+	if dollar := strings.IndexByte(rule, '$'); dollar >= 0 {
+		// rules with options apply to specific requests only
+		return nil
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if rule == "" || strings.ContainsAny(rule, "/*^|") {
+		return nil
+	}
+	return []string{"." + rule}
+}
+
+func parseDnsmasqLine(value string) []string {
+	// /domain1/domain2/.../[target]
+	parts := strings.Split(value, "/")
+	var patterns []string
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain == "" || domain == "#" {
+			continue
+		}
+		patterns = append(patterns, "."+strings.TrimPrefix(domain, "."))
+	}
+	return patterns
+}
+
+const patternFetchTimeout = time.Minute
+
+type remoteList struct {
+	patterns     []string
+	skipped      int
+	etag         string
+	lastModified string
+	fetchedAt    time.Time
+	// fetching is set while the list is fetched in the background
+	fetching bool
+}
+
+// cachedList is a pattern list stored in the cache directory.
+type cachedList struct {
+	URL          string    `json:"url"`
+	Patterns     []string  `json:"patterns"`
+	Skipped      int       `json:"skipped"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+// remoteLists caches pattern lists downloaded from PatternURLs, so that
+// config reloads do not need to fetch them again. The lists are fetched in
+// the background, so a slow server does not delay loading the config. Until
+// a list is fetched, the last one stored in the cache directory is used.
+type remoteLists struct {
+	ctx    context.Context
+	client *http.Client
+	// mu guards the lists and the cache directory
+	mu       sync.Mutex
+	lists    map[string]*remoteList
+	cacheDir string
+	// changed receives a value when a fetched list changes
+	changed chan struct{}
+}
+
+func newRemoteLists(ctx context.Context) *remoteLists {
+	return &remoteLists{
+		ctx:     ctx,
+		client:  &http.Client{Timeout: patternFetchTimeout},
+		lists:   make(map[string]*remoteList),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// defaultPatternCacheDir is in the user cache directory, empty when there
+// is none.
+func defaultPatternCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "flexi-proxy", "patterns")
+}
+
+// setCacheDir sets the directory of the cached lists, empty disables it.
+func (r *remoteLists) setCacheDir(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheDir = dir
+}
+
+// get returns the patterns and the number of skipped lines of the list.
+// A list which was not fetched yet is read from the cache directory, or it
+// is empty, and it is fetched in the background.
+func (r *remoteLists) get(env *environment.Environment, listUrl string) (patterns []string, skipped int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, ok := r.lists[listUrl]
+	if !ok {
+		list = r.readCache(env, listUrl)
+		r.lists[listUrl] = list
+		r.startFetch(env, listUrl, list)
+	}
+	return list.patterns, list.skipped
+}
+
+// refresh fetches lists older than the period again in the background.
+// Lists no longer used by the config are dropped.
+func (r *remoteLists) refresh(env *environment.Environment, period time.Duration) {
+	used := make(map[string]bool)
+	for _, rule := range env.Config().Rules {
+		for _, listUrl := range rule.PatternURLs {
+			used[listUrl] = true
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for listUrl, list := range r.lists {
+		if !used[listUrl] {
+			delete(r.lists, listUrl)
+			continue
+		}
+		if period <= 0 || time.Since(list.fetchedAt) < period {
+			continue
+		}
+		env.Debug("Refreshing pattern list", "url", listUrl)
+		r.startFetch(env, listUrl, list)
+	}
+}
+
+// startFetch fetches the list in the background, unless it is fetched
+// already. The changed channel is notified when the list changes.
+func (r *remoteLists) startFetch(env *environment.Environment, listUrl string, list *remoteList) {
+	if list.fetching {
+		return
+	}
+	list.fetching = true
+	etag, lastModified := list.etag, list.lastModified
+	go func() {
+		fetched, err := r.fetch(listUrl, etag, lastModified)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		list.fetching = false
+		list.fetchedAt = time.Now()
+		if err != nil {
+			env.Warn("Cannot fetch pattern list", "error", err)
+			return
+		}
+		if fetched == nil {
+			// not modified
+			return
+		}
+		modified := !equalPatterns(fetched.patterns, list.patterns)
+		list.patterns, list.skipped = fetched.patterns, fetched.skipped
+		list.etag, list.lastModified = fetched.etag, fetched.lastModified
+		r.writeCache(env, listUrl, list)
+		if modified {
+			select {
+			case r.changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// fetch downloads the list, it returns nil when the list is not modified.
+func (r *remoteLists) fetch(listUrl string, etag string, lastModified string) (*remoteList, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, listUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", listUrl, err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: got response status: %s", listUrl, resp.Status)
+	}
+	patterns, skipped, err := parsePatternList(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", listUrl, err)
+	}
+	return &remoteList{
+		patterns:     patterns,
+		skipped:      skipped,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func (r *remoteLists) cachePath(listUrl string) string {
+	sum := sha256.Sum256([]byte(listUrl))
+	return filepath.Join(r.cacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readCache returns the list stored in the cache directory, or an empty
+// list.
+func (r *remoteLists) readCache(env *environment.Environment, listUrl string) *remoteList {
+	if r.cacheDir == "" {
+		return &remoteList{}
+	}
+	data, err := os.ReadFile(r.cachePath(listUrl))
+	var cached cachedList
+	if err == nil {
+		err = json.Unmarshal(data, &cached)
+	}
+	if err != nil || cached.URL != listUrl {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			env.Warn("Cannot read cached pattern list", "url", listUrl, "error", err)
+		}
+		return &remoteList{}
+	}
+	env.Debug("Using cached pattern list", "url", listUrl, "fetched", cached.FetchedAt)
+	return &remoteList{
+		patterns:     cached.Patterns,
+		skipped:      cached.Skipped,
+		etag:         cached.ETag,
+		lastModified: cached.LastModified,
+		fetchedAt:    cached.FetchedAt,
+	}
+}
+
+// writeCache stores the list in the cache directory.
+func (r *remoteLists) writeCache(env *environment.Environment, listUrl string, list *remoteList) {
+	if r.cacheDir == "" {
+		return
+	}
+	data, err := json.Marshal(cachedList{
+		URL:          listUrl,
+		Patterns:     list.patterns,
+		Skipped:      list.skipped,
+		ETag:         list.etag,
+		LastModified: list.lastModified,
+		FetchedAt:    list.fetchedAt,
+	})
+	if err == nil {
+		err = os.MkdirAll(r.cacheDir, 0o755)
+	}
+	if err == nil {
+		// replaced at once, so a partially written list is never read
+		tmp := r.cachePath(listUrl) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, r.cachePath(listUrl))
+		}
+	}
+	if err != nil {
+		env.Warn("Cannot cache pattern list", "url", listUrl, "error", err)
+	}
+}
+
+func equalPatterns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
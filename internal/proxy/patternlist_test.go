@@ -0,0 +1,171 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePatternList(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     string
+		patterns []string
+		skipped  int
+	}{
+		{"plain", "the.test\n.sub.test\n10.0.0.0/8\n", []string{"the.test", ".sub.test", "10.0.0.0/8"}, 0},
+		{"comments", "# comment\n\n  the.test  # trailing\n! adblock comment\n", []string{"the.test"}, 0},
+		{"hosts", "127.0.0.1 localhost\n0.0.0.0 ads.test tracker.test\n::1 ip6-localhost\n", []string{"ads.test", "tracker.test"}, 0},
+		{"adblock", "[Adblock Plus 2.0]\n||ads.test^\n||tracker.test^$third-party\n##.banner\n@@||good.test^\n/banner/*\n", []string{".ads.test"}, 3},
+		{"dnsmasq", "server=/corp.test/10.0.0.1\naddress=/a.test/b.test/0.0.0.0\nlocal=/lan.test/\n", []string{".corp.test", ".a.test", ".b.test", ".lan.test"}, 0},
+		{"invalid", "two words\n", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, skipped, err := parsePatternList(strings.NewReader(tt.list))
+			if err != nil {
+				t.Fatalf("Failed to parse list: %v", err)
+			}
+			if !equalPatterns(patterns, tt.patterns) {
+				t.Fatalf("List should have patterns %v, got %v", tt.patterns, patterns)
+			}
+			if skipped != tt.skipped {
+				t.Fatalf("List should have %d skipped lines, got %d", tt.skipped, skipped)
+			}
+		})
+	}
+}
+
+// waitForChange waits until a fetched list changes, it fails the test
+// when none changes.
+func waitForChange(t *testing.T, lists *remoteLists) {
+	select {
+	case <-lists.changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("List should change")
+	}
+}
+
+// waitForFetches waits until no list is fetched.
+func waitForFetches(lists *remoteLists) {
+	for {
+		lists.mu.Lock()
+		fetching := false
+		for _, list := range lists.lists {
+			fetching = fetching || list.fetching
+		}
+		lists.mu.Unlock()
+		if !fetching {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRemoteLists_Refresh(t *testing.T) {
+	var mu sync.Mutex
+	version := 1
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if req.Header.Get("If-None-Match") == etag {
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+		res.Header().Set("ETag", etag)
+		_, _ = fmt.Fprintf(res, ".v%d.test\n", version)
+	}))
+	defer server.Close()
+	setVersion := func(v int) {
+		mu.Lock()
+		defer mu.Unlock()
+		version = v
+	}
+	countRequests := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	err := env.SetConfig(&environment.Config{Rules: []environment.Rule{
+		{PatternURLs: []string{server.URL}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	lists := newRemoteLists(context.Background())
+	if patterns, _ := lists.get(env, server.URL); len(patterns) != 0 {
+		t.Fatalf("List should be fetched in the background, got %v", patterns)
+	}
+	waitForChange(t, lists)
+	if patterns, _ := lists.get(env, server.URL); !equalPatterns(patterns, []string{".v1.test"}) {
+		t.Fatalf("List should be fetched, got %v", patterns)
+	}
+	if requests := countRequests(); requests != 1 {
+		t.Fatalf("List should be fetched once, got %d requests", requests)
+	}
+	setVersion(2)
+	lists.refresh(env, time.Hour)
+	waitForFetches(lists)
+	if countRequests() != 1 {
+		t.Fatalf("List should not be fetched before the refresh period")
+	}
+	setVersion(1)
+	lists.refresh(env, time.Nanosecond)
+	waitForFetches(lists)
+	if len(lists.changed) != 0 || countRequests() != 2 {
+		t.Fatalf("List should not change when not modified")
+	}
+	setVersion(2)
+	lists.refresh(env, time.Nanosecond)
+	waitForChange(t, lists)
+	if patterns, _ := lists.get(env, server.URL); !equalPatterns(patterns, []string{".v2.test"}) {
+		t.Fatalf("List should be refreshed, got %v", patterns)
+	}
+}
+
+func TestRemoteLists_Cache(t *testing.T) {
+	var unavailable atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if unavailable.Load() {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprint(res, ".cached.test\n")
+	}))
+	defer server.Close()
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	dir := t.TempDir()
+
+	lists := newRemoteLists(context.Background())
+	lists.setCacheDir(dir)
+	lists.get(env, server.URL)
+	waitForChange(t, lists)
+
+	unavailable.Store(true)
+	lists = newRemoteLists(context.Background())
+	lists.setCacheDir(dir)
+	if patterns, _ := lists.get(env, server.URL); !equalPatterns(patterns, []string{".cached.test"}) {
+		t.Fatalf("Cached list should be used before fetching it, got %v", patterns)
+	}
+	waitForFetches(lists)
+	if patterns, _ := lists.get(env, server.URL); !equalPatterns(patterns, []string{".cached.test"}) {
+		t.Fatalf("Cached list should be kept when fetching fails, got %v", patterns)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ConfigSource describes where the configuration comes from. The settings
+// are taken from these layers, each one overriding the previous ones:
+//  1. defaults
+//  2. the config file, followed by the files it includes
+//  3. environment variables, like FLEXI_HTTP_LISTEN_ADDR
+//  4. command line flags, like --http-listen-addr
+//
+// Rules can be defined only in config files.
+type ConfigSource struct {
+	Path string
+	// Format of the config file, by its extension when empty
+	Format string
+	// Flags are settings given on the command line, by their names
+	Flags map[string]string
+}
+
+// setting is a config setting which can be overridden by an environment
+// variable and a command line flag.
+type setting struct {
+	name  string
+	env   string
+	flag  string
+	usage string
+}
+
+var settings = []setting{
+	{"HttpListenAddr", "FLEXI_HTTP_LISTEN_ADDR", "http-listen-addr", "address of the HTTP proxy, empty to disable it"},
+	{"SocksListenAddr", "FLEXI_SOCKS_LISTEN_ADDR", "socks-listen-addr", "address of the SOCKS proxy, empty to disable it"},
+	{"MetricsListenAddr", "FLEXI_METRICS_LISTEN_ADDR", "metrics-listen-addr", "address serving Prometheus metrics at /metrics, empty to disable it"},
+	{"AdminListenAddr", "FLEXI_ADMIN_LISTEN_ADDR", "admin-listen-addr", "address of the admin API, empty to disable it"},
+	{"AdminToken", "FLEXI_ADMIN_TOKEN", "admin-token", "bearer token required by the admin API, better given by the environment variable"},
+	{"ConnectTimeoutMillis", "FLEXI_CONNECT_TIMEOUT_MILLIS", "connect-timeout-millis", "connection timeout"},
+	{"ReadTimeoutMillis", "FLEXI_READ_TIMEOUT_MILLIS", "read-timeout-millis", "HTTP request read timeout"},
+	{"WriteTimeoutMillis", "FLEXI_WRITE_TIMEOUT_MILLIS", "write-timeout-millis", "HTTP response write timeout"},
+	{"KeepAliveMillis", "FLEXI_KEEP_ALIVE_MILLIS", "keep-alive-millis", "TCP keep-alive period"},
+	{"UpstreamMaxIdleConnections", "FLEXI_UPSTREAM_MAX_IDLE_CONNECTIONS", "upstream-max-idle-connections", "idle connections kept for reuse by plain HTTP requests, 0 disables reusing them"},
+	{"UpstreamMaxIdleConnectionsPerHost", "FLEXI_UPSTREAM_MAX_IDLE_CONNECTIONS_PER_HOST", "upstream-max-idle-connections-per-host", "idle connections kept for reuse by plain HTTP requests to each target, 0 for the same limit"},
+	{"UpstreamIdleTimeoutMillis", "FLEXI_UPSTREAM_IDLE_TIMEOUT_MILLIS", "upstream-idle-timeout-millis", "closing connections kept for reuse after being idle for the time, 0 disables it"},
+	{"TunnelIdleTimeoutMillis", "FLEXI_TUNNEL_IDLE_TIMEOUT_MILLIS", "tunnel-idle-timeout-millis", "closing tunnels transferring nothing for the time, 0 disables it"},
+	{"TunnelMaxLifetimeMillis", "FLEXI_TUNNEL_MAX_LIFETIME_MILLIS", "tunnel-max-lifetime-millis", "closing tunnels open for the time, 0 disables it"},
+	{"PatternRefreshMillis", "FLEXI_PATTERN_REFRESH_MILLIS", "pattern-refresh-millis", "refresh period of pattern URLs"},
+	{"PatternCacheDir", "FLEXI_PATTERN_CACHE_DIR", "pattern-cache-dir", "directory keeping the last fetched pattern URLs, empty disables it"},
+	{"UploadLimitKBps", "FLEXI_UPLOAD_LIMIT_KBPS", "upload-limit-kbps", "upload bandwidth of all connections in KiB/s, 0 for no limit"},
+	{"DownloadLimitKBps", "FLEXI_DOWNLOAD_LIMIT_KBPS", "download-limit-kbps", "download bandwidth of all connections in KiB/s, 0 for no limit"},
+	{"ClientUploadLimitKBps", "FLEXI_CLIENT_UPLOAD_LIMIT_KBPS", "client-upload-limit-kbps", "upload bandwidth of each client address in KiB/s, 0 for no limit"},
+	{"ClientDownloadLimitKBps", "FLEXI_CLIENT_DOWNLOAD_LIMIT_KBPS", "client-download-limit-kbps", "download bandwidth of each client address in KiB/s, 0 for no limit"},
+	{"ClientConnectionsPerSecond", "FLEXI_CLIENT_CONNECTIONS_PER_SECOND", "client-connections-per-second", "new connections and HTTP requests of each client address per second, 0 for no limit"},
+	{"ClientMaxConnections", "FLEXI_CLIENT_MAX_CONNECTIONS", "client-max-connections", "concurrent connections and HTTP requests of each client address, 0 for no limit"},
+	{"MaxConnections", "FLEXI_MAX_CONNECTIONS", "max-connections", "concurrent accepted connections of all listeners, 0 for no limit"},
+	{"HttpMaxConnections", "FLEXI_HTTP_MAX_CONNECTIONS", "http-max-connections", "concurrent accepted connections of the HTTP proxy, except idle keep-alive ones, 0 for no limit"},
+	{"SocksMaxConnections", "FLEXI_SOCKS_MAX_CONNECTIONS", "socks-max-connections", "concurrent connections of the SOCKS proxy, 0 for no limit"},
+	{"DestinationMaxConnections", "FLEXI_DESTINATION_MAX_CONNECTIONS", "destination-max-connections", "concurrent tunnels and HTTP requests to each target address, 0 for no limit"},
+	{"QueueTimeoutMillis", "FLEXI_QUEUE_TIMEOUT_MILLIS", "queue-timeout-millis", "time for connections over a limit to wait for a free slot, 0 rejects them right away"},
+	{"QueueMaxConnections", "FLEXI_QUEUE_MAX_CONNECTIONS", "queue-max-connections", "accepted connections waiting for a free slot of each listener, more are rejected right away, 0 for no limit"},
+	{"ShutdownDrainMillis", "FLEXI_SHUTDOWN_DRAIN_MILLIS", "shutdown-drain-millis", "time for connections to finish on SIGINT or SIGTERM before closing them"},
+	{"GeoIPDatabase", "FLEXI_GEOIP_DATABASE", "geoip-database", "path to MaxMind GeoIP country database"},
+	{"ASNDatabase", "FLEXI_ASN_DATABASE", "asn-database", "path to MaxMind ASN database"},
+	{"Verbosity", "FLEXI_VERBOSITY", "verbosity", "log verbosity: error, warn, info or debug"},
+	{"LogFormat", "FLEXI_LOG_FORMAT", "log-format", "log format: text or json"},
+	{"AccessLog", "FLEXI_ACCESS_LOG", "access-log", "path of the access log, - for stdout, empty to disable it"},
+	{"AccessLogFormat", "FLEXI_ACCESS_LOG_FORMAT", "access-log-format", "access log format: common, combined or json"},
+	{"AccessLogMaxSizeMB", "FLEXI_ACCESS_LOG_MAX_SIZE_MB", "access-log-max-size-mb", "size of the access log rotating it, 100 when 0"},
+	{"AccessLogMaxBackups", "FLEXI_ACCESS_LOG_MAX_BACKUPS", "access-log-max-backups", "number of rotated access logs to keep, all when 0"},
+	{"SystemProxyRules", "FLEXI_SYSTEM_PROXY_RULES", "system-proxy-rules", "append rules from HTTP_PROXY and NO_PROXY variables: true or false"},
+}
+
+var verbosityNames = map[string]int64{
+	"error": int64(environment.Error),
+	"warn":  int64(environment.Warn),
+	"info":  int64(environment.Info),
+	"debug": int64(environment.Debug),
+}
+
+// AddSettingFlags defines command line flags overriding config settings,
+// storing the given values into the map.
+func AddSettingFlags(flags *flag.FlagSet, values map[string]string) {
+	for _, s := range settings {
+		s := s
+		flags.Func(s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(value string) error {
+			if err := s.set(&environment.Config{}, value); err != nil {
+				return err
+			}
+			values[s.name] = value
+			return nil
+		})
+	}
+}
+
+func (s *setting) set(cfg *environment.Config, value string) error {
+	field := reflect.ValueOf(cfg).Elem().FieldByName(s.name)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		if s.name == "Verbosity" {
+			v, err := ParseVerbosity(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(v))
+			return nil
+		}
+		v, err := strconv.ParseInt(value, 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid %s `%s`", s.name, value)
+		}
+		field.SetInt(v)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s `%s`", s.name, value)
+		}
+		field.SetBool(v)
+	default:
+		panic("unsupported setting type: " + s.name)
+	}
+	return nil
+}
+
+// ParseVerbosity parses the verbosity given by its name, like `debug`, or
+// its number.
+func ParseVerbosity(value string) (int, error) {
+	if v, ok := verbosityNames[strings.ToLower(value)]; ok {
+		return int(v), nil
+	}
+	v, err := strconv.ParseInt(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Verbosity `%s`", value)
+	}
+	return int(v), nil
+}
+
+// applyOverrides sets the settings from environment variables and flags,
+// recording their sources.
+func applyOverrides(cfg *environment.Config, flags map[string]string, sources map[string]string) error {
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(cfg, value); err != nil {
+				return fmt.Errorf("%s: %w", s.env, err)
+			}
+			sources[s.name] = "env " + s.env
+		}
+		if value, ok := flags[s.name]; ok {
+			if err := s.set(cfg, value); err != nil {
+				return fmt.Errorf("--%s: %w", s.flag, err)
+			}
+			sources[s.name] = "flag --" + s.flag
+		}
+	}
+	return nil
+}
+
+// logSettings logs the effective settings with their sources.
+func logSettings(env *environment.Environment, cfg *environment.Config, sources map[string]string) {
+	value := reflect.ValueOf(cfg.Redacted()).Elem()
+	for _, s := range settings {
+		source, ok := sources[s.name]
+		if !ok {
+			source = "default"
+		}
+		env.Debug("Setting", "name", s.name, "value", value.FieldByName(s.name).Interface(), "source", source)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"flag"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig_Overrides(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"proxy.toml": `
+HttpListenAddr = "127.0.0.1:9001"
+SocksListenAddr = "127.0.0.1:9002"
+Verbosity = 1
+[[Rules]]
+Patterns = ["."]
+`,
+	})
+	t.Setenv("FLEXI_HTTP_LISTEN_ADDR", "0.0.0.0:8001")
+	t.Setenv("FLEXI_VERBOSITY", "info")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := map[string]string{}
+	AddSettingFlags(flags, values)
+	if err := flags.Parse([]string{"--verbosity=debug", "--connect-timeout-millis", "500"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	var out bytes.Buffer
+	env, err := LoadEnvironment(ConfigSource{Path: filepath.Join(dir, "proxy.toml"), Flags: values}, environment.NewLogger(&out, ""))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg := env.Config()
+	if cfg.HttpListenAddr != "0.0.0.0:8001" || cfg.SocksListenAddr != "127.0.0.1:9002" || cfg.Verbosity != environment.Debug || cfg.ConnectTimeoutMillis != 500 {
+		t.Fatalf("Settings should be overridden by environment and flags, got %+v", cfg)
+	}
+	for _, line := range []string{
+		`name=HttpListenAddr value=0.0.0.0:8001 source="env FLEXI_HTTP_LISTEN_ADDR"`,
+		`name=SocksListenAddr value=127.0.0.1:9002 source="file ` + filepath.Join(dir, "proxy.toml") + `"`,
+		`name=Verbosity value=3 source="flag --verbosity"`,
+		`name=PatternRefreshMillis value=3600000 source=default`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("Debug output should contain `%s`, got: %s", line, out.String())
+		}
+	}
+}
+
+func TestLoadConfig_InvalidOverride(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"proxy.toml": `Rules = []`})
+	t.Setenv("FLEXI_CONNECT_TIMEOUT_MILLIS", "10s")
+	_, err := LoadEnvironment(ConfigSource{Path: filepath.Join(dir, "proxy.toml")}, environment.NewLogger(io.Discard, ""))
+	if err == nil || !strings.Contains(err.Error(), "FLEXI_CONNECT_TIMEOUT_MILLIS") {
+		t.Fatalf("Invalid environment variable should be reported, got %v", err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	AddSettingFlags(flags, map[string]string{})
+	if err := flags.Parse([]string{"--verbosity=loud"}); err == nil {
+		t.Fatalf("Invalid flag value should be rejected")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// systemProxyRules translates the proxy environment variables into rules,
+// appended to the configured ones when SystemProxyRules is enabled:
+//   - NO_PROXY entries are direct rules, `*` makes all connections direct,
+//     domains match also their subdomains, IPs and CIDRs match addresses
+//     and an entry with a port matches only that port
+//   - HTTPS_PROXY is used for port 443, HTTP_PROXY for the other ports and
+//     ALL_PROXY for either when it is not set, so port 443 is direct
+//     without HTTPS_PROXY and ALL_PROXY even with HTTP_PROXY
+//
+// Like in Go and curl, the upper case variables take precedence. Only HTTP
+// proxies are supported.
+func systemProxyRules(env *environment.Environment, cfg *environment.Config, getenv func(string) string) []environment.Rule {
+	lookup := func(name string) string {
+		if value := getenv(strings.ToUpper(name)); value != "" {
+			return value
+		}
+		return getenv(name)
+	}
+	rules, all := noProxyRules(env, lookup("no_proxy"))
+	if all {
+		return rules
+	}
+	allProxy := lookup("all_proxy")
+	httpProxy := systemProxyUrl(env, cfg, "HTTP_PROXY", lookup("http_proxy"), allProxy)
+	httpsProxy := systemProxyUrl(env, cfg, "HTTPS_PROXY", lookup("https_proxy"), allProxy)
+	if httpsProxy != "" && httpsProxy != httpProxy {
+		rules = append(rules, environment.Rule{
+			Proxy:    httpsProxy,
+			Patterns: []string{".", "0.0.0.0/0", "::/0"},
+			Ports:    []string{"443"},
+		})
+	}
+	if httpProxy != "" {
+		rule := environment.Rule{
+			Proxy:    httpProxy,
+			Patterns: []string{".", "0.0.0.0/0", "::/0"},
+		}
+		if httpsProxy != httpProxy {
+			rule.Ports = []string{"!443"}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// systemProxyUrl normalizes the proxy URL, returning an empty string for
+// unsupported proxies and for the proxy itself.
+func systemProxyUrl(env *environment.Environment, cfg *environment.Config, name string, value string, fallback string) string {
+	if value == "" {
+		value = fallback
+	}
+	if value == "" {
+		return ""
+	}
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme != "http" || u.User != nil || u.Host == "" {
+		env.Warn("Ignoring proxy variable, only HTTP proxies without credentials are supported", "variable", name, "value", value)
+		return ""
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if isListenAddr(u.Hostname(), u.Port(), cfg.HttpListenAddr) {
+		env.Warn("Ignoring proxy variable pointing to this proxy", "variable", name, "value", value)
+		return ""
+	}
+	return "http://" + u.Host
+}
+
+// isListenAddr reports whether the host and port point to the listen
+// address, loopback hosts point to any local or unspecified listen host.
+func isListenAddr(host string, port string, listenAddr string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	if strings.EqualFold(host, listenHost) {
+		return true
+	}
+	return isLoopback(host) && (listenHost == "" || isLoopback(listenHost) || net.ParseIP(listenHost).IsUnspecified())
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// noProxyRules translates NO_PROXY into direct rules, one for each port.
+// It reports whether all connections are direct.
+func noProxyRules(env *environment.Environment, noProxy string) ([]environment.Rule, bool) {
+	var rules []environment.Rule
+	byPort := map[string]int{}
+	for _, entry := range strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if entry == "*" {
+			return []environment.Rule{{Patterns: []string{".", "0.0.0.0/0", "::/0"}}}, true
+		}
+		pattern, port, err := noProxyPattern(entry)
+		if err != nil {
+			env.Warn("Ignoring NO_PROXY entry", "entry", entry, "error", err)
+			continue
+		}
+		i, ok := byPort[port]
+		if !ok {
+			i = len(rules)
+			byPort[port] = i
+			rules = append(rules, environment.Rule{})
+			if port != "" {
+				rules[i].Ports = []string{port}
+			}
+		}
+		rules[i].Patterns = append(rules[i].Patterns, pattern)
+	}
+	return rules, false
+}
+
+// noProxyPattern translates a NO_PROXY entry into a subdomain or CIDR pattern
+// and an optional port.
+func noProxyPattern(entry string) (string, string, error) {
+	host, port := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+			return "", "", fmt.Errorf("invalid port `%s`", p)
+		}
+		host, port = h, p
+	}
+	if _, ipNet, err := net.ParseCIDR(host); err == nil {
+		return ipNet.String(), port, nil
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return fmt.Sprintf("%s/%d", ip, bits), port, nil
+	}
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	domain, err := environment.NormalizeDomainName(host)
+	if err != nil {
+		return "", "", err
+	}
+	if domain == "" {
+		return "", "", fmt.Errorf("domain name is required")
+	}
+	return "." + domain, port, nil
+}
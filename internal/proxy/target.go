@@ -0,0 +1,123 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var defaultPorts = map[string]uint16{
+	"http":  80,
+	"https": 443,
+	"ws":    80,
+	"wss":   443,
+}
+
+// Target is the destination of a proxied request. Exactly one of Host and IP
+// is set, depending on whether the client asked for a name or an IP literal.
+type Target struct {
+	Host string
+	IP   netip.Addr
+	Port uint16
+}
+
+// ParseTarget parses `host:port` as found in a CONNECT request or an URL.
+// IPv6 literals are accepted with or without brackets, including zone IDs.
+// When the port is missing, the default port of the scheme is used.
+func ParseTarget(hostPort string, scheme string) (Target, error) {
+	host, port, err := splitHostPort(hostPort)
+	if err != nil {
+		return Target{}, err
+	}
+	var t Target
+	if port == "" {
+		p, ok := defaultPorts[strings.ToLower(scheme)]
+		if !ok {
+			return Target{}, fmt.Errorf("address `%s` has no port", hostPort)
+		}
+		t.Port = p
+	} else {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return Target{}, fmt.Errorf("address `%s` has invalid port", hostPort)
+		}
+		t.Port = uint16(p)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		t.IP = ip
+	} else if t.Host, err = normalizeHost(host); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
+
+// TargetFromAddrPort creates a target from already separated parts, as
+// provided by the SOCKS protocol.
+func TargetFromAddrPort(fqdn string, ip net.IP, port int) (Target, error) {
+	t := Target{
+		Port: uint16(port),
+	}
+	if fqdn == "" {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			t.IP = addr.Unmap()
+		}
+		return t, nil
+	}
+	host, err := normalizeHost(fqdn)
+	if err != nil {
+		return Target{}, err
+	}
+	t.Host = host
+	return t, nil
+}
+
+func normalizeHost(host string) (string, error) {
+	normalized, err := environment.NormalizeDomainName(host)
+	if err != nil {
+		return "", err
+	}
+	if normalized == "" {
+		return "", fmt.Errorf("host `%s` is invalid", host)
+	}
+	return normalized, nil
+}
+
+func splitHostPort(hostPort string) (host, port string, err error) {
+	if hostPort == "" {
+		return "", "", fmt.Errorf("address is empty")
+	}
+	if _, err := netip.ParseAddr(hostPort); err == nil {
+		// bare IPv6 literal without brackets, or IPv4 without port
+		return hostPort, "", nil
+	}
+	if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		return hostPort[1 : len(hostPort)-1], "", nil
+	}
+	if strings.LastIndexByte(hostPort, ':') < 0 {
+		return hostPort, "", nil
+	}
+	host, port, err = net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", "", fmt.Errorf("address `%s` is invalid: %w", hostPort, err)
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("address `%s` has no host", hostPort)
+	}
+	return host, port, nil
+}
+
+// String returns the address suitable for dialing.
+func (t Target) String() string {
+	host := t.Host
+	if t.IP.IsValid() {
+		host = t.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(t.Port)))
+}
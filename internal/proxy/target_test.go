@@ -0,0 +1,124 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package proxy
+
+import (
+	"github.com/psvo/flexi-proxy/internal/environment"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostPort string
+		scheme   string
+		host     string
+		ip       string
+		port     uint16
+		dialAddr string
+	}{
+		{"IPv4 with port", "192.168.5.1:8080", "", "", "192.168.5.1", 8080, "192.168.5.1:8080"},
+		{"IPv4 default port", "192.168.5.1", "http", "", "192.168.5.1", 80, "192.168.5.1:80"},
+		{"IPv6 with port", "[2001:db8::1]:443", "", "", "2001:db8::1", 443, "[2001:db8::1]:443"},
+		{"IPv6 default port", "[2001:db8::1]", "https", "", "2001:db8::1", 443, "[2001:db8::1]:443"},
+		{"IPv6 bare", "2001:db8::1", "http", "", "2001:db8::1", 80, "[2001:db8::1]:80"},
+		{"IPv6 zone", "[fe80::1%eth0]:22", "", "", "fe80::1%eth0", 22, "[fe80::1%eth0]:22"},
+		{"domain with port", "the.test:8443", "", "the.test", "", 8443, "the.test:8443"},
+		{"domain upper case", "The.TEST:8443", "", "the.test", "", 8443, "the.test:8443"},
+		{"domain trailing dot", "the.test.:8443", "", "the.test", "", 8443, "the.test:8443"},
+		{"domain default port", "the.test", "HTTP", "the.test", "", 80, "the.test:80"},
+		{"bare host", "localhost:3128", "", "localhost", "", 3128, "localhost:3128"},
+		{"bare host default port", "intranet", "https", "intranet", "", 443, "intranet:443"},
+		{"IDN unicode", "bücher.example:443", "", "xn--bcher-kva.example", "", 443, "xn--bcher-kva.example:443"},
+		{"IDN punycode", "xn--bcher-kva.example", "https", "xn--bcher-kva.example", "", 443, "xn--bcher-kva.example:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := ParseTarget(tt.hostPort, tt.scheme)
+			if err != nil {
+				t.Fatalf("Failed to parse `%s`: %v", tt.hostPort, err)
+			}
+			if target.Host != tt.host {
+				t.Fatalf("Target `%s` should have host `%s`, got `%s`", tt.hostPort, tt.host, target.Host)
+			}
+			if tt.ip == "" && target.IP.IsValid() {
+				t.Fatalf("Target `%s` should have no IP, got `%v`", tt.hostPort, target.IP)
+			}
+			if tt.ip != "" && target.IP != netip.MustParseAddr(tt.ip) {
+				t.Fatalf("Target `%s` should have IP `%s`, got `%v`", tt.hostPort, tt.ip, target.IP)
+			}
+			if target.Port != tt.port {
+				t.Fatalf("Target `%s` should have port %d, got %d", tt.hostPort, tt.port, target.Port)
+			}
+			if target.String() != tt.dialAddr {
+				t.Fatalf("Target `%s` should dial `%s`, got `%s`", tt.hostPort, tt.dialAddr, target.String())
+			}
+		})
+	}
+}
+
+func TestParseTarget_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostPort string
+		scheme   string
+	}{
+		{"empty", "", "http"},
+		{"missing port", "the.test", ""},
+		{"missing IPv6 port", "[2001:db8::1]", ""},
+		{"unknown scheme", "the.test", "gopher"},
+		{"bad port", "the.test:http", ""},
+		{"zero port", "the.test:0", ""},
+		{"port out of range", "the.test:65536", ""},
+		{"missing host", ":443", ""},
+		{"unbracketed IPv6 with port", "2001:db8::1:443:x", ""},
+		{"unclosed bracket", "[2001:db8::1:443", ""},
+		{"invalid label", "-the.test:443", ""},
+		{"empty label", "the..test:443", ""},
+		{"invalid character", "the/test:443", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if target, err := ParseTarget(tt.hostPort, tt.scheme); err == nil {
+				t.Fatalf("Address `%s` should be rejected, got %+v", tt.hostPort, target)
+			}
+		})
+	}
+}
+
+func TestTargetFromAddrPort(t *testing.T) {
+	target, err := TargetFromAddrPort("", net.ParseIP("192.168.5.1"), 443)
+	if err != nil || target.String() != "192.168.5.1:443" {
+		t.Fatalf("Target should dial IPv4 address, got `%s`: %v", target, err)
+	}
+	target, err = TargetFromAddrPort("Bücher.Example.", nil, 443)
+	if err != nil || target.String() != "xn--bcher-kva.example:443" {
+		t.Fatalf("Target should dial normalized domain name, got `%s`: %v", target, err)
+	}
+	if _, err = TargetFromAddrPort("-the.test", nil, 443); err == nil {
+		t.Fatalf("Invalid domain name should be rejected")
+	}
+}
+
+func TestResolveDialer_IPv6Cidr(t *testing.T) {
+	env := environment.NewEnvironment(environment.NewLogger(io.Discard, ""))
+	err := env.SetConfig(&environment.Config{Rules: []environment.Rule{
+		{Proxy: "http://proxy.test:3128", Patterns: []string{"2001:db8::/32"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to set config: %v", err)
+	}
+	target, err := ParseTarget("[2001:db8::1]:443", "")
+	if err != nil {
+		t.Fatalf("Failed to parse target: %v", err)
+	}
+	dialer := ResolveDialer(env, target, "127.0.0.1:12345")
+	if dialer.String() != "PROXY http://proxy.test:3128" {
+		t.Fatalf("IPv6 target should match CIDR rule, got `%s`", dialer)
+	}
+}
@@ -5,38 +5,45 @@
 package socksproxy
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/accesslog"
+	"github.com/psvo/flexi-proxy/internal/conntrack"
 	"github.com/psvo/flexi-proxy/internal/environment"
+	"github.com/psvo/flexi-proxy/internal/metrics"
 	"github.com/psvo/flexi-proxy/internal/proxy"
 	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/bufferpool"
 	"github.com/things-go/go-socks5/statute"
+	"io"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type ctxRequestKey struct{}
-type ctxDialerKey struct{}
+// listenerName labels the metrics of the SOCKS proxy.
+const listenerName = "socks"
+
+type ctxRouteKey struct{}
+type ctxErrorKey struct{}
 
 type myLogger struct {
 	env *environment.Environment
 }
 
 func (sl *myLogger) Errorf(format string, args ...interface{}) {
-	sl.env.Error(format, args...)
+	sl.env.Error(fmt.Sprintf(format, args...))
 }
 
-type myResolver struct {
-	env         *environment.Environment
-	netResolver net.Resolver
-}
+// myResolver defers the lookup to the rewriter, which resolves
+// the name only when some rule needs the IP address.
+type myResolver struct{}
 
-func (r *myResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	ips, err := r.netResolver.LookupIP(ctx, "ip", name)
-	if err != nil {
-		return ctx, nil, err
-	}
-	ip := ips[0]
-	r.env.Debug("resolve: %s => %s\n", name, ip.String())
-	return ctx, ip, nil
+func (r *myResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
 }
 
 type myRewriter struct {
@@ -45,36 +52,300 @@ type myRewriter struct {
 
 func (r *myRewriter) Rewrite(ctx context.Context, request *socks5.Request) (context.Context, *statute.AddrSpec) {
 	dest := request.DestAddr
-	dialer := proxy.ResolveDialer(r.env, dest.FQDN, dest.IP)
-	ctx = context.WithValue(ctx, ctxRequestKey{}, request)
-	ctx = context.WithValue(ctx, ctxDialerKey{}, dialer)
-	r.env.Debug("rewrite: %s => %s", dest.Address(), dialer)
+	target, err := proxy.TargetFromAddrPort(dest.FQDN, dest.IP, dest.Port)
+	if err != nil {
+		return context.WithValue(ctx, ctxErrorKey{}, err), dest
+	}
+	route := proxy.ResolveRoute(r.env, target, request.RemoteAddr.String())
+	metrics.RuleHit(route.Rule)
+	ctx = context.WithValue(ctx, ctxRouteKey{}, route)
+	r.env.Debug("Resolved", append([]any{"target", targetAddress(dest)}, route.LogAttrs()...)...)
+	if dest.FQDN != "" {
+		// dial the normalized name
+		normalized := *dest
+		normalized.FQDN = target.Host
+		dest = &normalized
+	}
 	return ctx, dest
 }
 
+// targetAddress is the requested address, by the name if it was given.
+func targetAddress(dest *statute.AddrSpec) string {
+	if dest.FQDN != "" {
+		return net.JoinHostPort(dest.FQDN, strconv.Itoa(dest.Port))
+	}
+	return net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
+}
+
 type myDialer struct {
 	env *environment.Environment
 }
 
 func (d *myDialer) dial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if err, ok := ctx.Value(ctxErrorKey{}).(error); ok {
+		return nil, err
+	}
 	timeout := d.env.Config().ConnectTimeout()
-	req := ctx.Value(ctxRequestKey{}).(*socks5.Request)
-	dialer := ctx.Value(ctxDialerKey{}).(proxy.Dialer)
-	d.env.Info("CONNECT %s (%s) => %s", req.DestAddr.FQDN, addr, dialer)
+	route := ctx.Value(ctxRouteKey{}).(*proxy.Route)
+	d.env.Debug("Connecting", "address", addr, "dialer", route.Dialer.String())
 	ctx2, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	conn, err = dialer.Dial(ctx2, network, addr)
+	conn, err = route.Dialer.Dial(ctx2, network, addr)
 	return conn, err
 }
 
-func ListenAndServe(env *environment.Environment) error {
+// myConnectHandler connects to the target like the default handler,
+// but relays the data by its own means to count them. It logs the result
+// of the request instead of returning errors to the server.
+type myConnectHandler struct {
+	env        *environment.Environment
+	limiter    *proxy.Limiter
+	dial       func(ctx context.Context, network, addr string) (net.Conn, error)
+	bufferPool bufferpool.BufPool
+}
+
+func (h *myConnectHandler) handle(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	entry := &accesslog.Entry{
+		Start:    time.Now(),
+		Listener: listenerName,
+		Client:   request.RemoteAddr.String(),
+		Method:   "CONNECT",
+		Target:   targetAddress(request.RawDestAddr),
+		Rule:     -1,
+	}
+	start := entry.Start
+	cfg := h.env.Config()
+	release, err := h.limiter.Admit(cfg, entry.Client)
+	if err != nil {
+		env := h.env.With("client", entry.Client, "method", entry.Method, "target", entry.Target)
+		h.reject(env, writer, entry, statute.RepRuleFailure, http.StatusTooManyRequests, err)
+		return nil
+	}
+	defer release()
+	tracked := writer.(*sessionConn).tracked
+	tracked.SetTarget(entry.Target)
+	env := h.env.With("conn", tracked.ID(), "client", entry.Client, "method", entry.Method, "target", entry.Target)
+	route, _ := ctx.Value(ctxRouteKey{}).(*proxy.Route)
+	if route != nil {
+		entry.Rule, entry.Dialer = route.Rule, route.Dialer.String()
+		tracked.SetRoute(entry.Rule, entry.Dialer)
+		env = env.With(route.LogAttrs()...)
+	}
+	// the same key as the HTTP proxy uses, not the dialed address
+	destination := entry.Target
+	if route != nil {
+		destination = route.Target.String()
+	}
+	releaseSlot, err := h.limiter.AcquireDestination(ctx, cfg, destination)
+	if err != nil {
+		h.reject(env, writer, entry, statute.RepServerFailure, http.StatusServiceUnavailable, err)
+		return nil
+	}
+	defer releaseSlot()
+	target, err := h.dial(ctx, "tcp", request.DestAddr.String())
+	if err != nil {
+		reply := statute.RepHostUnreachable
+		if msg := err.Error(); strings.Contains(msg, "refused") {
+			reply = statute.RepConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			reply = statute.RepNetworkUnreachable
+		}
+		env.Error("Connecting failed", "duration", time.Since(start), "error", err)
+		if err := socks5.SendReply(writer, reply, nil); err != nil {
+			env.Error("Sending reply failed", "error", err)
+		}
+		status := http.StatusBadGateway
+		if _, invalid := ctx.Value(ctxErrorKey{}).(error); invalid {
+			status = http.StatusBadRequest
+		}
+		entry.Record(h.env, status, err)
+		return nil
+	}
+	defer func() { _ = target.Close() }()
+	// killing the session stops waiting for the bandwidth limits
+	shapeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tracked.OnKill(cancel)
+	target = h.limiter.Shape(shapeCtx, route, entry.Client, tracked.Wrap(target))
+	if err := socks5.SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+		env.Error("Sending reply failed", "error", err)
+		entry.Record(h.env, http.StatusOK, err)
+		return nil
+	}
+	defer tracked.Limit(route.IdleTimeout, route.MaxLifetime)()
+	var upstream, downstream int64
+	type relayEnd struct {
+		direction string
+		err       error
+	}
+	ends := make(chan relayEnd, 2)
+	go func() {
+		var err error
+		upstream, err = h.relay(target, request.Reader, metrics.Upstream)
+		ends <- relayEnd{metrics.Upstream, err}
+	}()
+	go func() {
+		var err error
+		downstream, err = h.relay(writer, target, metrics.Downstream)
+		ends <- relayEnd{metrics.Downstream, err}
+	}()
+	var first string
+	var relayErr error
+	for i := 0; i < 2; i++ {
+		end := <-ends
+		if first == "" {
+			first = end.direction
+		}
+		if end.err != nil && relayErr == nil {
+			relayErr = end.err
+			// stop the other direction too
+			_ = target.Close()
+			if closer, ok := writer.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+	}
+	entry.Upstream, entry.Downstream = upstream, downstream
+	closed := tracked.Err()
+	reason := proxy.TunnelCloseReason(closed, relayErr, first)
+	attrs := append(proxy.TransferAttrs(start, upstream, downstream), "reason", reason)
+	switch {
+	case closed != nil:
+		if closed == conntrack.ErrKilled {
+			env.Warn("Tunnel closed", attrs...)
+		} else {
+			env.Info("Tunnel closed", attrs...)
+		}
+		relayErr = closed
+	case relayErr != nil:
+		env.Error("Proxy tunnel error", append(attrs, "error", relayErr)...)
+	default:
+		env.Info("Tunnel closed", attrs...)
+	}
+	entry.Record(h.env, http.StatusOK, relayErr)
+	return nil
+}
+
+// reject replies to the request rejected by a limit, logging the HTTP status
+// equivalent to the reply.
+func (h *myConnectHandler) reject(env *environment.Environment, writer io.Writer, entry *accesslog.Entry, reply uint8, status int, err error) {
+	env.Warn("Connection rejected", "error", err)
+	metrics.ConnectionRejected(listenerName, err.(*proxy.Rejection).Reason)
+	if err := socks5.SendReply(writer, reply, nil); err != nil {
+		env.Error("Sending reply failed", "error", err)
+	}
+	entry.Record(h.env, status, err)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies the data from src to dst, counting them as transferred
+// in the direction.
+func (h *myConnectHandler) relay(dst io.Writer, src io.Reader, direction string) (int64, error) {
+	buf := h.bufferPool.Get()
+	defer h.bufferPool.Put(buf)
+	n, err := io.CopyBuffer(dst, metrics.CountingReader(src, listenerName, direction), buf[:cap(buf)])
+	if tcpConn, ok := dst.(closeWriter); ok {
+		_ = tcpConn.CloseWrite()
+	}
+	return n, err
+}
+
+// sessionConn is a client connection tracked as a SOCKS session.
+type sessionConn struct {
+	net.Conn
+	tracked *conntrack.Conn
+}
+
+// CloseWrite half-closes the connection, if it is supported.
+func (c *sessionConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// serveSessions serves the accepted connections like socks5.Server.Serve,
+// but it tracks them in the registry from the start, so they are drained and
+// killed also during the handshake.
+func serveSessions(server *socks5.Server, logger *myLogger, l net.Listener, conns *conntrack.Registry) error {
+	defer func() { _ = l.Close() }()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		tracked := conns.Add(listenerName, conn.RemoteAddr().String(), "")
+		tracked.OnKill(func() { _ = conn.Close() })
+		go func() {
+			defer tracked.Done()
+			if err := server.ServeConn(&sessionConn{Conn: conn, tracked: tracked}); err != nil {
+				logger.Errorf("server: %v", err)
+			}
+		}()
+	}
+}
+
+func maxConnections(cfg *environment.Config) int {
+	return cfg.SocksMaxConnections
+}
+
+// rejectConn replies with a server failure to the connection rejected by
+// the listener limits, after its greeting and its request.
+func rejectConn(conn net.Conn) {
+	greeting, err := statute.ParseMethodRequest(conn)
+	if err != nil {
+		return
+	}
+	if !bytes.Contains(greeting.Methods, []byte{statute.MethodNoAuth}) {
+		_, _ = conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable})
+		return
+	}
+	if _, err := conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth}); err != nil {
+		return
+	}
+	if _, err := statute.ParseRequest(conn); err != nil {
+		return
+	}
+	_ = socks5.SendReply(conn, statute.RepServerFailure, nil)
+}
+
+// ListenAndServe serves the SOCKS proxy, tracking its sessions in
+// the registry and limiting them by the limiter. It stops accepting
+// connections when the context is done, active sessions are left to
+// the registry to drain.
+func ListenAndServe(ctx context.Context, env *environment.Environment, conns *conntrack.Registry, limiter *proxy.Limiter) error {
 	addr := env.Config().SocksListenAddr
+	dialer := &myDialer{env: env}
+	connectHandler := &myConnectHandler{
+		env:        env,
+		limiter:    limiter,
+		dial:       dialer.dial,
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+	logger := &myLogger{env: env}
 	server := socks5.NewServer(
-		socks5.WithLogger(&myLogger{env: env}),
-		socks5.WithResolver(&myResolver{env: env}),
+		socks5.WithLogger(logger),
+		socks5.WithResolver(&myResolver{}),
 		socks5.WithRewriter(&myRewriter{env: env}),
-		socks5.WithDial((&myDialer{env: env}).dial),
+		socks5.WithDial(dialer.dial),
+		socks5.WithConnectHandle(connectHandler.handle),
 	)
-	env.Info("listening on: socks5://%s", addr)
-	return server.ListenAndServe("tcp", addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	env.Info("Listening", "url", "socks5://"+addr)
+	go func() {
+		<-ctx.Done()
+		env.Info("Stopped listening")
+		_ = l.Close()
+	}()
+	err = serveSessions(server, logger, limiter.LimitListener(env, metrics.CountConnections(l, listenerName), listenerName, maxConnections, rejectConn), conns)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
 }
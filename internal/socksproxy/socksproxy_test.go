@@ -0,0 +1,59 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package socksproxy
+
+import (
+	"bytes"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRejectConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go func() {
+		rejectConn(server)
+		_ = server.Close()
+	}()
+	if _, err := client.Write([]byte{5, 1, statute.MethodNoAuth}); err != nil {
+		t.Fatalf("Failed to write greeting: %v", err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil || !bytes.Equal(method, []byte{5, statute.MethodNoAuth}) {
+		t.Fatalf("Greeting should be accepted without authentication, got %v %v", method, err)
+	}
+	// CONNECT 127.0.0.1:80
+	if _, err := client.Write([]byte{5, statute.CommandConnect, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 80}); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	reply, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply.Response != statute.RepServerFailure {
+		t.Fatalf("Rejected connection should get the server failure reply, got %d", reply.Response)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Rejected connection should be closed, got %v", err)
+	}
+}
+
+func TestRejectConn_NoAcceptableMethod(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go func() {
+		rejectConn(server)
+		_ = server.Close()
+	}()
+	if _, err := client.Write([]byte{5, 1, statute.MethodUserPassAuth}); err != nil {
+		t.Fatalf("Failed to write greeting: %v", err)
+	}
+	reply, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(reply, []byte{5, statute.MethodNoAcceptable}) {
+		t.Fatalf("Greeting without supported methods should be refused, got %v %v", reply, err)
+	}
+}
@@ -5,63 +5,228 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/admin"
+	"github.com/psvo/flexi-proxy/internal/conntrack"
+	"github.com/psvo/flexi-proxy/internal/environment"
 	"github.com/psvo/flexi-proxy/internal/httpproxy"
+	"github.com/psvo/flexi-proxy/internal/metrics"
 	"github.com/psvo/flexi-proxy/internal/proxy"
 	"github.com/psvo/flexi-proxy/internal/socksproxy"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 )
 
-func runHttpProxy(loader *proxy.EnvLoader, logPrefix string) {
+// Exit codes of the proxy, besides 2 for invalid flags.
+const (
+	// stopped by SIGINT or SIGTERM with all connections finished
+	exitOK = 0
+	// the configuration could not be loaded or a listener failed
+	exitFailure = 1
+	// stopped by a signal, but connections had to be closed after
+	// the drain period
+	exitConnectionsClosed = 3
+)
+
+func runHttpProxy(ctx context.Context, loader *proxy.EnvLoader, conns *conntrack.Registry, limiter *proxy.Limiter, logPrefix string) error {
 	env := loader.Env().WithLogger(mkLogger(logPrefix))
 	if env.Config().HttpListenAddr == "" {
-		return
-	}
-	if err := httpproxy.ListenAndServe(env); err != nil {
-		panic(err)
+		return nil
 	}
+	return httpproxy.ListenAndServe(ctx, env, conns, limiter)
 }
 
-func runSocksProxy(loader *proxy.EnvLoader, logPrefix string) {
+func runSocksProxy(ctx context.Context, loader *proxy.EnvLoader, conns *conntrack.Registry, limiter *proxy.Limiter, logPrefix string) error {
 	env := loader.Env().WithLogger(mkLogger(logPrefix))
 	if env.Config().SocksListenAddr == "" {
-		return
+		return nil
+	}
+	return socksproxy.ListenAndServe(ctx, env, conns, limiter)
+}
+
+func runAdmin(ctx context.Context, loader *proxy.EnvLoader, conns *conntrack.Registry, logPrefix string) error {
+	env := loader.Env().WithLogger(mkLogger(logPrefix))
+	if env.Config().AdminListenAddr == "" {
+		return nil
+	}
+	return admin.ListenAndServe(ctx, env, loader, conns)
+}
+
+func runMetrics(ctx context.Context, loader *proxy.EnvLoader, logPrefix string) error {
+	env := loader.Env().WithLogger(mkLogger(logPrefix))
+	addr := env.Config().MetricsListenAddr
+	if addr == "" {
+		return nil
 	}
-	if err := socksproxy.ListenAndServe(env); err != nil {
-		panic(err)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          env.Logger(),
 	}
+	env.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
-func runAsync(wg *sync.WaitGroup, fn func()) {
+// runAsync runs the function, sending its failure to the channel.
+func runAsync(wg *sync.WaitGroup, failures chan<- error, fn func() error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		fn()
+		if err := fn(); err != nil {
+			failures <- err
+		}
 	}()
 }
 
-func mkLogger(prefix string) *log.Logger {
-	return log.New(os.Stderr, prefix+" ", log.LstdFlags|log.Lmsgprefix)
+// drainConnections waits for the connections to finish, up to the drain
+// period or until another signal, then it closes the rest. It returns
+// the number of closed connections.
+func drainConnections(env *environment.Environment, conns *conntrack.Registry, signals <-chan os.Signal) int {
+	period := env.Config().ShutdownDrain()
+	ctx, cancel := context.WithTimeout(context.Background(), period)
+	defer cancel()
+	if n := conns.Count(); n > 0 {
+		env.Info("Waiting for connections to finish", "connections", n, "period", period)
+	}
+	go func() {
+		select {
+		case sig := <-signals:
+			env.Warn("Received another signal, closing connections", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if conns.Wait(ctx) {
+		return 0
+	}
+	closed := conns.KillAll()
+	env.Warn("Closed unfinished connections", "connections", closed)
+	// let the closed connections be logged
+	logCtx, logCancel := context.WithTimeout(context.Background(), time.Second)
+	defer logCancel()
+	conns.Wait(logCtx)
+	return closed
 }
 
-func main() {
-	var confFilePath = "proxy.toml"
-	flag.StringVar(&confFilePath, "c", confFilePath, "path to configuration file")
-	flag.Parse()
-	loader, err := proxy.NewEnvironmentLoader(confFilePath, 3*time.Second, mkLogger("config"))
+// runProxy serves the proxies until SIGINT or SIGTERM, or until a listener
+// fails, and returns the exit code.
+func runProxy(source *proxy.ConfigSource) int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return serveProxies(source, signals)
+}
+
+// serveProxies serves the proxies until a signal is received, or until
+// a listener fails, and returns the exit code.
+func serveProxies(source *proxy.ConfigSource, signals <-chan os.Signal) int {
+	loader, err := proxy.NewEnvironmentLoader(*source, 3*time.Second, mkLogger("config"))
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Cannot load config file: %v\n", err)
+		return exitFailure
 	}
 	defer loader.Stop()
+	env := loader.Env().WithLogger(mkLogger("main"))
+	conns := conntrack.NewRegistry()
+	limiter := proxy.NewLimiter()
+	// the proxies stop accepting connections first, the admin API and
+	// metrics stay available while the connections are drained
+	proxiesCtx, stopProxies := context.WithCancel(context.Background())
+	defer stopProxies()
+	servicesCtx, stopServices := context.WithCancel(context.Background())
+	defer stopServices()
+	failures := make(chan error, 4)
 	wg := &sync.WaitGroup{}
-	defer wg.Wait()
-	runAsync(wg, func() {
-		runHttpProxy(loader, "http")
+	runAsync(wg, failures, func() error {
+		return runHttpProxy(proxiesCtx, loader, conns, limiter, "http")
+	})
+	runAsync(wg, failures, func() error {
+		return runSocksProxy(proxiesCtx, loader, conns, limiter, "socks")
 	})
-	runAsync(wg, func() {
-		runSocksProxy(loader, "socks")
+	runAsync(wg, failures, func() error {
+		return runMetrics(servicesCtx, loader, "metrics")
 	})
+	runAsync(wg, failures, func() error {
+		return runAdmin(servicesCtx, loader, conns, "admin")
+	})
+	// all listeners may be disabled
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	code := exitOK
+	select {
+	case sig := <-signals:
+		env.Info("Received signal, shutting down", "signal", sig.String())
+	case err := <-failures:
+		env.Error("Listener failed, shutting down", "error", err)
+		code = exitFailure
+	case <-finished:
+		return exitOK
+	}
+	stopProxies()
+	if closed := drainConnections(env, conns, signals); closed > 0 && code == exitOK {
+		code = exitConnectionsClosed
+	}
+	stopServices()
+	wg.Wait()
+	env.Info("Stopped", "exit_code", code)
+	return code
+}
+
+// addConfigFlags defines the flags selecting the config file and
+// overriding its settings.
+func addConfigFlags(flags *flag.FlagSet) *proxy.ConfigSource {
+	source := &proxy.ConfigSource{
+		Path:  "proxy.toml",
+		Flags: map[string]string{},
+	}
+	flags.StringVar(&source.Path, "c", source.Path, "path to configuration file")
+	flags.StringVar(&source.Format, "format", "", "configuration file format: toml, json or yaml, by the file extension by default")
+	proxy.AddSettingFlags(flags, source.Flags)
+	usage := flags.Usage
+	flags.Usage = func() {
+		usage()
+		fmt.Fprintf(flags.Output(), "\nSettings are taken from defaults, the configuration file, FLEXI_* environment\nvariables and the flags above, the later ones taking precedence.\n")
+	}
+	return source
+}
+
+func mkLogger(subsystem string) *environment.Logger {
+	return environment.NewLogger(os.Stderr, subsystem)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			os.Exit(runExplain(os.Args[2:]))
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
+	}
+	source := addConfigFlags(flag.CommandLine)
+	flag.Parse()
+	os.Exit(runProxy(source))
 }
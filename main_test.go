@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023 Petr Svoboda
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/psvo/flexi-proxy/internal/proxy"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address with a port which is not in use.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	return l.Addr().String()
+}
+
+// startProxies serves the proxies with the drain period, returning their
+// addresses, the signal channel and the channel of the exit code.
+func startProxies(t *testing.T, drainMillis int) (string, string, chan<- os.Signal, <-chan int) {
+	httpAddr, socksAddr := freeAddr(t), freeAddr(t)
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	config := fmt.Sprintf(`
+HttpListenAddr = "%s"
+SocksListenAddr = "%s"
+MetricsListenAddr = ""
+AdminListenAddr = ""
+ShutdownDrainMillis = %d
+[[Rules]]
+Patterns = ["."]
+`, httpAddr, socksAddr, drainMillis)
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	signals := make(chan os.Signal, 2)
+	code := make(chan int, 1)
+	go func() {
+		code <- serveProxies(&proxy.ConfigSource{Path: path, Flags: map[string]string{}}, signals)
+		close(code)
+	}()
+	t.Cleanup(func() {
+		select {
+		case signals <- syscall.SIGTERM:
+		default:
+		}
+		<-code
+	})
+	for _, addr := range []string{httpAddr, socksAddr} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Proxy should listen on `%s`, got %v", addr, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return httpAddr, socksAddr, signals, code
+}
+
+// dialSession opens a SOCKS session which stays in the handshake.
+func dialSession(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	// the version only, the server waits for the methods
+	if _, err := conn.Write([]byte{5}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	return conn
+}
+
+// waitStopped waits until the address refuses connections.
+func waitStopped(t *testing.T, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("Listener `%s` should be stopped", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeProxies_Drain(t *testing.T) {
+	httpAddr, socksAddr, signals, code := startProxies(t, 10_000)
+	session := dialSession(t, socksAddr)
+	signals <- syscall.SIGTERM
+	waitStopped(t, httpAddr)
+	waitStopped(t, socksAddr)
+	select {
+	case c := <-code:
+		t.Fatalf("Shutdown should wait for the session in the handshake, got exit code %d", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = session.Close()
+	select {
+	case c := <-code:
+		if c != exitOK {
+			t.Fatalf("Exit code should be %d when all connections finished, got %d", exitOK, c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown should finish after the session is closed")
+	}
+}
+
+func TestServeProxies_DrainTimeout(t *testing.T) {
+	_, socksAddr, signals, code := startProxies(t, 100)
+	session := dialSession(t, socksAddr)
+	signals <- syscall.SIGTERM
+	select {
+	case c := <-code:
+		if c != exitConnectionsClosed {
+			t.Fatalf("Exit code should be %d when connections were closed, got %d", exitConnectionsClosed, c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown should finish after the drain period")
+	}
+	_ = session.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := session.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Session should be closed after the drain period, got %v", err)
+	}
+}